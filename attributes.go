@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-chef/chef"
+)
+
+// attributePrecedence is the order in which Chef merges the node attribute levels, highest first
+var attributePrecedence = []string{"automatic", "override", "normal", "default"}
+
+// nodeAttributes returns the node as a generic map, keyed like its JSON representation.
+func nodeAttributes(node *chef.Node) map[string]interface{} {
+	runList := make([]interface{}, 0, len(node.RunList))
+	for _, item := range node.RunList {
+		runList = append(runList, item)
+	}
+	return map[string]interface{}{
+		"name":             node.Name,
+		"chef_environment": node.Environment,
+		"policy_name":      node.PolicyName,
+		"policy_group":     node.PolicyGroup,
+		"run_list":         runList,
+		"automatic":        node.AutomaticAttributes,
+		"override":         node.OverrideAttributes,
+		"normal":           node.NormalAttributes,
+		"default":          node.DefaultAttributes,
+	}
+}
+
+// lookupAttribute resolves a dotted path such as "automatic.fqdn" or "fqdn" on the node attributes.
+// Paths not starting with a top-level key of the node are looked up in every attribute level,
+// following Chef's precedence.
+func lookupAttribute(attrs map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	if _, ok := attrs[keys[0]]; ok {
+		return lookupKeys(attrs, keys)
+	}
+	for _, level := range attributePrecedence {
+		if v, ok := lookupKeys(attrs[level], keys); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func lookupKeys(v interface{}, keys []string) (interface{}, bool) {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// attributeString formats a scalar attribute value, failing for maps and lists.
+func attributeString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool, int:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("attribute of type %T is not a scalar", v)
+	}
+}
+
+// nodeRecipes returns the recipes of the node expanded run list, as reported by ohai.
+func nodeRecipes(node *chef.Node) []string {
+	raw, _ := node.AutomaticAttributes["recipes"].([]interface{})
+	recipes := make([]string, 0, len(raw))
+	for _, r := range raw {
+		if recipe, ok := r.(string); ok {
+			recipes = append(recipes, recipe)
+		}
+	}
+	return recipes
+}
+
+// nodeTags returns the tags of the node, set in its normal attributes by the node itself.
+func nodeTags(node *chef.Node) []string {
+	return attributeTags(node.NormalAttributes)
+}
+
+// attributeTags returns the tags of an attribute map.
+func attributeTags(attributes interface{}) []string {
+	m, _ := attributes.(map[string]interface{})
+	raw, _ := m["tags"].([]interface{})
+	tags := make([]string, 0, len(raw))
+	for _, t := range raw {
+		if tag, ok := t.(string); ok {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// nodeRoles returns the expanded roles of the node, as reported by ohai.
+func nodeRoles(node *chef.Node) []string {
+	raw, _ := node.AutomaticAttributes["roles"].([]interface{})
+	roles := make([]string, 0, len(raw))
+	for _, r := range raw {
+		if role, ok := r.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
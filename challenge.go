@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// challengeTTL is the time a node has to use an issued nonce
+	challengeTTL = 2 * time.Minute
+	// maxPendingNonces bounds the unused nonces issued for a node name, challenges are not authenticated
+	maxPendingNonces = 10
+	// maxPendingNoncesTotal bounds the unused nonces issued for every node name
+	maxPendingNoncesTotal = 10000
+)
+
+// nonceEntry is a single-use nonce issued to a node for a signed login
+type nonceEntry struct {
+	NodeName  string    `json:"node_name"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// pendingNonces tracks the unused nonces issued by this Vault node, by node name, so unauthenticated challenges can't
+// fill the storage
+type pendingNonces struct {
+	sync.Mutex
+	nodes map[string]map[string]time.Time
+	total int
+}
+
+// add records a nonce issued for nodeName, failing when too many nonces are pending for it or overall.
+func (p *pendingNonces) add(nodeName, nonce string, expiresAt time.Time) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.nodes == nil {
+		p.nodes = map[string]map[string]time.Time{}
+	}
+
+	now := time.Now()
+	p.expireNode(nodeName, now)
+	if p.total >= maxPendingNoncesTotal {
+		for n := range p.nodes {
+			p.expireNode(n, now)
+		}
+	}
+	if len(p.nodes[nodeName]) >= maxPendingNonces {
+		return fmt.Errorf("too many pending challenges for node %q", nodeName)
+	}
+	if p.total >= maxPendingNoncesTotal {
+		return fmt.Errorf("too many pending challenges")
+	}
+
+	if p.nodes[nodeName] == nil {
+		p.nodes[nodeName] = map[string]time.Time{}
+	}
+	p.nodes[nodeName][nonce] = expiresAt
+	p.total++
+	return nil
+}
+
+// remove forgets a used nonce.
+func (p *pendingNonces) remove(nodeName, nonce string) {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.nodes[nodeName][nonce]; !ok {
+		return
+	}
+	delete(p.nodes[nodeName], nonce)
+	p.total--
+	if len(p.nodes[nodeName]) == 0 {
+		delete(p.nodes, nodeName)
+	}
+}
+
+// expire forgets the expired nonces.
+func (p *pendingNonces) expire() {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	for n := range p.nodes {
+		p.expireNode(n, now)
+	}
+}
+
+// expireNode forgets the expired nonces of a node name. p must be locked.
+func (p *pendingNonces) expireNode(nodeName string, now time.Time) {
+	for nonce, expiresAt := range p.nodes[nodeName] {
+		if now.After(expiresAt) {
+			delete(p.nodes[nodeName], nonce)
+			p.total--
+		}
+	}
+	if len(p.nodes[nodeName]) == 0 {
+		delete(p.nodes, nodeName)
+	}
+}
+
+func pathChallenge(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "login/challenge",
+		Fields: map[string]*framework.FieldSchema{
+			"node_name": {
+				Type:        framework.TypeString,
+				Description: "The optional node name the nonce should be bound to.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathChallengeWrite,
+		},
+		HelpSynopsis:    "Issue a single-use nonce for a signed login.",
+		HelpDescription: "Issue a short-lived single-use nonce which must be included in the payload signed by the node.",
+	}
+}
+
+func (b *backend) pathChallengeWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	nodeName := d.Get("node_name").(string)
+
+	nonce, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &nonceEntry{
+		NodeName:  nodeName,
+		ExpiresAt: time.Now().Add(challengeTTL).UTC(),
+	}
+	if err := b.pendingNonces.add(nodeName, nonce, n.ExpiresAt); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	entry, err := logical.StorageEntryJSON("nonce/"+nonce, n)
+	if err != nil {
+		b.pendingNonces.remove(nodeName, nonce)
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		b.pendingNonces.remove(nodeName, nonce)
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"nonce":      nonce,
+			"node_name":  nodeName,
+			"expires_at": n.ExpiresAt.Format(time.RFC3339),
+			"ttl":        int64(challengeTTL.Seconds()),
+		},
+	}, nil
+}
+
+// consumeNonce removes a nonce from the ledger, failing if it was never issued, already used, expired
+// or bound to another node.
+func (b *backend) consumeNonce(ctx context.Context, req *logical.Request, nonce, nodeName string) error {
+	if _, err := uuid.ParseUUID(nonce); err != nil {
+		return fmt.Errorf("invalid nonce: %s", err)
+	}
+
+	b.nonceLock.Lock()
+	defer b.nonceLock.Unlock()
+
+	raw, err := req.Storage.Get(ctx, "nonce/"+nonce)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		return fmt.Errorf("nonce was not issued or was already used")
+	}
+	if err := req.Storage.Delete(ctx, "nonce/"+nonce); err != nil {
+		return err
+	}
+
+	n := &nonceEntry{}
+	if err := json.Unmarshal(raw.Value, n); err != nil {
+		return err
+	}
+	b.pendingNonces.remove(n.NodeName, nonce)
+	if time.Now().After(n.ExpiresAt) {
+		return fmt.Errorf("nonce expired at %s", n.ExpiresAt.Format(time.RFC3339))
+	}
+	if n.NodeName != "" && n.NodeName != nodeName {
+		return fmt.Errorf("nonce was issued for node %s", n.NodeName)
+	}
+	return nil
+}
+
+// recordNonce adds an externally generated nonce to the ledger, failing if it is already known.
+func (b *backend) recordNonce(ctx context.Context, req *logical.Request, nonce, nodeName string, expiresAt time.Time) error {
+	b.nonceLock.Lock()
+	defer b.nonceLock.Unlock()
+
+	raw, err := req.Storage.Get(ctx, "nonce/"+nonce)
+	if err != nil {
+		return err
+	}
+	if raw != nil {
+		return fmt.Errorf("nonce was already used")
+	}
+
+	entry, err := logical.StorageEntryJSON("nonce/"+nonce, &nonceEntry{NodeName: nodeName, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	return req.Storage.Put(ctx, entry)
+}
+
+// tidyNonces deletes the expired entries of the nonce ledger. The ledger is read without holding nonceLock, so logins
+// are not blocked while it is walked: expired entries can't be used anymore, whatever happens to them meanwhile.
+func (b *backend) tidyNonces(ctx context.Context, req *logical.Request) error {
+	b.pendingNonces.expire()
+
+	nonces, err := req.Storage.List(ctx, "nonce/")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, nonce := range nonces {
+		raw, err := req.Storage.Get(ctx, "nonce/"+nonce)
+		if err != nil {
+			return err
+		}
+		if raw == nil {
+			continue
+		}
+		n := &nonceEntry{}
+		if err := json.Unmarshal(raw.Value, n); err == nil && !now.After(n.ExpiresAt) {
+			continue
+		}
+		if err := b.deleteNonce(ctx, req, nonce); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) deleteNonce(ctx context.Context, req *logical.Request, nonce string) error {
+	b.nonceLock.Lock()
+	defer b.nonceLock.Unlock()
+	return req.Storage.Delete(ctx, "nonce/"+nonce)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestNonceSingleUse(t *testing.T) {
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+	nonce := testChallenge(t, b, storage, "node1")
+
+	if err := b.consumeNonce(context.Background(), req, nonce, "node1"); err != nil {
+		t.Fatalf("first use: %s", err)
+	}
+	if err := b.consumeNonce(context.Background(), req, nonce, "node1"); err == nil {
+		t.Fatal("expected the second use to fail")
+	}
+}
+
+func TestNonceExpired(t *testing.T) {
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+	nonce := testChallenge(t, b, storage, "node1")
+
+	n := &nonceEntry{}
+	entry, err := storage.Get(context.Background(), "nonce/"+nonce)
+	if err != nil || entry == nil {
+		t.Fatalf("reading the nonce: %v %v", entry, err)
+	}
+	if err := entry.DecodeJSON(n); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := time.Until(n.ExpiresAt); ttl > challengeTTL || ttl < challengeTTL-time.Minute {
+		t.Errorf("nonce expires in %s, expected %s", ttl, challengeTTL)
+	}
+
+	// As if the TTL had elapsed
+	n.ExpiresAt = time.Now().Add(-time.Second)
+	if entry, err = logical.StorageEntryJSON("nonce/"+nonce, n); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.consumeNonce(context.Background(), req, nonce, "node1"); err == nil {
+		t.Fatal("expected an expired nonce to fail")
+	}
+}
+
+func TestNonceOtherNode(t *testing.T) {
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+
+	nonce := testChallenge(t, b, storage, "node1")
+	if err := b.consumeNonce(context.Background(), req, nonce, "node2"); err == nil {
+		t.Fatal("expected a nonce bound to another node to fail")
+	}
+	// The failed attempt used the nonce
+	if err := b.consumeNonce(context.Background(), req, nonce, "node1"); err == nil {
+		t.Fatal("expected the nonce to be used")
+	}
+
+	// Nonces issued without node name can be used by any node
+	nonce = testChallenge(t, b, storage, "")
+	if err := b.consumeNonce(context.Background(), req, nonce, "node2"); err != nil {
+		t.Fatalf("unbound nonce: %s", err)
+	}
+}
+
+func TestTidyNonces(t *testing.T) {
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+
+	expired, err := logical.StorageEntryJSON("nonce/expired", &nonceEntry{NodeName: "node1", ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), expired); err != nil {
+		t.Fatal(err)
+	}
+	pending := testChallenge(t, b, storage, "node1")
+
+	if err := b.tidyNonces(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := storage.List(context.Background(), "nonce/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != pending {
+		t.Errorf("expected only the pending nonce to be kept, got %v", keys)
+	}
+}
+
+func TestChallengePendingBound(t *testing.T) {
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+
+	nonces := []string{}
+	for i := 0; i < maxPendingNonces; i++ {
+		nonces = append(nonces, testChallenge(t, b, storage, "node1"))
+	}
+	resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login/challenge", map[string]interface{}{"node_name": "node1"})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected the challenge to be rejected, got %v %v", resp, err)
+	}
+
+	// Other node names are not affected
+	testChallenge(t, b, storage, "node2")
+
+	// Used nonces free their slot
+	if err := b.consumeNonce(context.Background(), req, nonces[0], "node1"); err != nil {
+		t.Fatal(err)
+	}
+	testChallenge(t, b, storage, "node1")
+}
+
+func TestPendingNoncesTotalBound(t *testing.T) {
+	p := &pendingNonces{}
+	expiresAt := time.Now().Add(challengeTTL)
+	for i := 0; i < maxPendingNoncesTotal; i++ {
+		if err := p.add(fmt.Sprintf("node%d", i), "nonce", expiresAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.add("other", "nonce", expiresAt); err == nil {
+		t.Fatal("expected the total bound to be enforced")
+	}
+
+	// Expired nonces do not count
+	p.nodes["node0"]["nonce"] = time.Now().Add(-time.Second)
+	if err := p.add("other", "nonce", expiresAt); err != nil {
+		t.Fatalf("expected the expired nonce to be dropped: %s", err)
+	}
+}
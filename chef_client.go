@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chef/chef"
+)
+
+const (
+	chefRequestTimeout = 10 * time.Second
+	// searchPageSize is the number of rows requested per search page, as done by go-chef and knife
+	searchPageSize = 1000
+)
+
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// chefClient signs requests with go-chef but sends them with an HTTP client honoring the configured TLS settings,
+// which go-chef does not let us customize.
+type chefClient struct {
+	signer     *chef.Client
+	httpClient *http.Client
+}
+
+// newChefClient returns a Chef client authenticated as name against the configured host.
+func newChefClient(conf *config, name, key string) (*chefClient, error) {
+	signer, err := chef.NewClient(&chef.Config{
+		Name:    name,
+		Key:     key,
+		BaseURL: conf.Host,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := conf.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &chefClient{
+		signer: signer,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+			Timeout: chefRequestTimeout,
+		},
+	}, nil
+}
+
+// newAdminChefClient returns a Chef client authenticated with the configured client_name/client_key.
+func newAdminChefClient(conf *config) (*chefClient, error) {
+	if !conf.hasClient() {
+		return nil, fmt.Errorf("client_name and client_key are not configured")
+	}
+	return newChefClient(conf, conf.ClientName, conf.ClientKey)
+}
+
+// tlsConfig builds the TLS configuration used to talk to the Chef server.
+func (c *config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.TLSServerName,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if c.TLSMinVersion != "" {
+		v, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls_min_version %q", c.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+
+	if c.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.CACert)) {
+			return nil, fmt.Errorf("no valid certificate found in ca_cert")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// resolve returns the absolute URL of a Chef API path, whose segments are escaped as done by the get methods.
+func (c *chefClient) resolve(path string) (*url.URL, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.signer.BaseURL.ResolveReference(ref), nil
+}
+
+// identity identifies the Chef server and client the requests are sent to and signed as.
+func (c *chefClient) identity() string {
+	return c.signer.Auth.ClientName + "@" + c.signer.BaseURL.String()
+}
+
+// do signs and sends a request, decoding the JSON answer into v.
+func (c *chefClient) do(ctx context.Context, method, path string, body io.Reader, v interface{}) error {
+	req, err := c.signer.NewRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	return c.send(req.WithContext(ctx), v)
+}
+
+// send sends an already signed request, decoding the JSON answer into v.
+func (c *chefClient) send(req *http.Request, v interface{}) error {
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := chef.CheckResponse(res); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (c *chefClient) getNode(ctx context.Context, name string) (node chef.Node, err error) {
+	err = c.do(ctx, "GET", "nodes/"+url.PathEscape(name), nil, &node)
+	return
+}
+
+func (c *chefClient) getClient(ctx context.Context, name string) (client chef.ApiClient, err error) {
+	err = c.do(ctx, "GET", "clients/"+url.PathEscape(name), nil, &client)
+	return
+}
+
+func (c *chefClient) getClientKey(ctx context.Context, name, keyName string) (key chef.ApiClientKey, err error) {
+	err = c.do(ctx, "GET", fmt.Sprintf("clients/%s/keys/%s", url.PathEscape(name), url.PathEscape(keyName)), nil, &key)
+	return
+}
+
+func (c *chefClient) getRole(ctx context.Context, name string) (role chef.Role, err error) {
+	err = c.do(ctx, "GET", "roles/"+url.PathEscape(name), nil, &role)
+	return
+}
+
+func (c *chefClient) getEnvironment(ctx context.Context, name string) (env chef.Environment, err error) {
+	err = c.do(ctx, "GET", "environments/"+url.PathEscape(name), nil, &env)
+	return
+}
+
+// search runs a query on a Chef index, fetching every page of the result.
+func (c *chefClient) search(ctx context.Context, index, query string) (chef.SearchResult, error) {
+	return c.searchPages(ctx, "GET", index, query, nil)
+}
+
+// partialSearch runs a query on a Chef index, only returning the attributes of the filter for each row,
+// keyed by the filter keys.
+func (c *chefClient) partialSearch(ctx context.Context, index, query string, filter map[string][]string) (chef.SearchResult, error) {
+	return c.searchPages(ctx, "POST", index, query, filter)
+}
+
+func (c *chefClient) searchPages(ctx context.Context, method, index, query string, filter map[string][]string) (chef.SearchResult, error) {
+	res := chef.SearchResult{}
+	for start := 0; ; start += searchPageSize {
+		var body io.Reader
+		if filter != nil {
+			var err error
+			if body, err = chef.JSONReader(filter); err != nil {
+				return res, err
+			}
+		}
+		page := chef.SearchResult{}
+		if err := c.do(ctx, method, searchPath(index, query, start), body, &page); err != nil {
+			return res, err
+		}
+		res.Total = page.Total
+		res.Rows = append(res.Rows, page.Rows...)
+		if len(page.Rows) == 0 || start+searchPageSize >= page.Total {
+			return res, nil
+		}
+	}
+}
+
+func searchPath(index, query string, start int) string {
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("rows", strconv.Itoa(searchPageSize))
+	params.Set("sort", "X_CHEF_id_CHEF_X asc")
+	params.Set("start", strconv.Itoa(start))
+	return "search/" + url.PathEscape(index) + "?" + params.Encode()
+}
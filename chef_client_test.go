@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+var (
+	testKeysLock sync.Mutex
+	testKeys     = map[int]*rsa.PrivateKey{}
+)
+
+// testRSAKey returns the i-th RSA key of the tests, generated once for all of them.
+func testRSAKey(t testing.TB, i int) *rsa.PrivateKey {
+	testKeysLock.Lock()
+	defer testKeysLock.Unlock()
+	if k, ok := testKeys[i]; ok {
+		return k
+	}
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeys[i] = k
+	return k
+}
+
+// testPrivateKey returns the first RSA key of the tests, PEM encoded.
+func testPrivateKey(t testing.TB) string {
+	return privateKeyPEM(testRSAKey(t, 0))
+}
+
+func privateKeyPEM(k *rsa.PrivateKey) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}))
+}
+
+func publicKeyPEM(t testing.TB, k *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// testBackend returns a backend with in-memory storage.
+func testBackend(t testing.TB) (*backend, logical.Storage) {
+	conf := logical.TestBackendConfig()
+	conf.StorageView = &logical.InmemStorage{}
+	b := Backend(conf)
+	if err := b.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.clean(context.Background()) })
+	return b, conf.StorageView
+}
+
+func testRequest(t testing.TB, b *backend, storage logical.Storage, op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      path,
+		Storage:   storage,
+		Data:      data,
+	})
+}
+
+// testWrite writes data to path, failing the test on errors. As Vault does, writes are creations when the path has
+// an existence check reporting no entry.
+func testWrite(t testing.TB, b *backend, storage logical.Storage, path string, data map[string]interface{}) {
+	t.Helper()
+	var op logical.Operation = logical.UpdateOperation
+	checkFound, exists, err := b.HandleExistenceCheck(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      path,
+		Storage:   storage,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkFound && !exists {
+		op = logical.CreateOperation
+	}
+	resp, err := testRequest(t, b, storage, op, path, data)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("writing %s: %v %v", path, resp, err)
+	}
+}
+
+// nodeHandler serves GET /nodes/<name> for the given nodes.
+func nodeHandler(nodes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/nodes/")
+		for _, n := range nodes {
+			if r.Method == "GET" && name == n {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name":             n,
+					"chef_type":        "node",
+					"json_class":       "Chef::Node",
+					"chef_environment": "_default",
+				})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// chefAPI is a fake Chef server serving fixed objects, keyed by path, to the clients signing their requests with
+// their registered key, as go-chef does.
+type chefAPI struct {
+	*httptest.Server
+	sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	objects map[string]interface{}
+}
+
+func newChefAPI(t testing.TB) *chefAPI {
+	a := &chefAPI{keys: map[string]*rsa.PublicKey{}, objects: map[string]interface{}{}}
+	a.Server = httptest.NewServer(a)
+	t.Cleanup(a.Close)
+	return a
+}
+
+// addClient registers the key requests of the client name are verified with.
+func (a *chefAPI) addClient(name string, k *rsa.PrivateKey) {
+	a.Lock()
+	defer a.Unlock()
+	a.keys[name] = &k.PublicKey
+}
+
+// set serves v on GET path, or removes path when v is nil.
+func (a *chefAPI) set(path string, v interface{}) {
+	a.Lock()
+	defer a.Unlock()
+	if v == nil {
+		delete(a.objects, path)
+		return
+	}
+	a.objects[path] = v
+}
+
+func (a *chefAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.authenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	v, ok := a.objects[r.URL.Path]
+	if r.Method != "GET" || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// authenticated verifies the version 1.0 signature of a request.
+func (a *chefAPI) authenticated(r *http.Request) bool {
+	userID := r.Header.Get("X-Ops-Userid")
+	key, ok := a.keys[userID]
+	if !ok || r.Header.Get("X-Ops-Sign") != "algorithm=sha1;version=1.0" {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(opsAuthorization(r.Header), ""))
+	if err != nil {
+		return false
+	}
+	content := fmt.Sprintf("Method:%s\nHashed Path:%s\nX-Ops-Content-Hash:%s\nX-Ops-Timestamp:%s\nX-Ops-UserId:%s",
+		r.Method, chef.HashStr(path.Clean(r.URL.Path)), r.Header.Get("X-Ops-Content-Hash"), r.Header.Get("X-Ops-Timestamp"), userID)
+	return rsa.VerifyPKCS1v15(key, 0, []byte(content), sig) == nil
+}
+
+// chefNode returns the JSON representation of a node, as served by the Chef server.
+func chefNode(name string, roles ...string) map[string]interface{} {
+	runList := []interface{}{}
+	automaticRoles := []interface{}{}
+	for _, r := range roles {
+		runList = append(runList, "role["+r+"]")
+		automaticRoles = append(automaticRoles, r)
+	}
+	return map[string]interface{}{
+		"name":             name,
+		"chef_type":        "node",
+		"json_class":       "Chef::Node",
+		"chef_environment": "_default",
+		"run_list":         runList,
+		"automatic":        map[string]interface{}{"roles": automaticRoles},
+	}
+}
+
+func certPEM(srv *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+}
+
+func TestLoginTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(nodeHandler("node1"))
+	defer srv.Close()
+
+	// The test certificate is valid for 127.0.0.1 and example.com, not for localhost
+	localhost := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		ok     bool
+	}{
+		{"system CAs", map[string]interface{}{"host": srv.URL + "/"}, false},
+		{"ca_cert", map[string]interface{}{"host": srv.URL + "/", "ca_cert": certPEM(srv)}, true},
+		{"host not in the certificate", map[string]interface{}{"host": localhost + "/", "ca_cert": certPEM(srv)}, false},
+		{"tls_server_name", map[string]interface{}{"host": localhost + "/", "ca_cert": certPEM(srv), "tls_server_name": "example.com"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := testBackend(t)
+			testWrite(t, b, storage, "config", tt.config)
+			resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+				"node_name":   "node1",
+				"private_key": testPrivateKey(t),
+			})
+			if tt.ok && (err != nil || resp == nil || resp.Auth == nil) {
+				t.Fatalf("expected login to succeed, got %v %v", resp, err)
+			}
+			if !tt.ok && err != logical.ErrPermissionDenied {
+				t.Fatalf("expected permission denied, got %v %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestLoginTLSMinVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nodeHandler("node1"))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	for version, ok := range map[string]bool{"tls12": true, "tls13": false} {
+		t.Run(version, func(t *testing.T) {
+			b, storage := testBackend(t)
+			testWrite(t, b, storage, "config", map[string]interface{}{
+				"host":            srv.URL + "/",
+				"ca_cert":         certPEM(srv),
+				"tls_min_version": version,
+			})
+			resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+				"node_name":   "node1",
+				"private_key": testPrivateKey(t),
+			})
+			if ok && (err != nil || resp == nil || resp.Auth == nil) {
+				t.Fatalf("expected login to succeed, got %v %v", resp, err)
+			}
+			if !ok && err != logical.ErrPermissionDenied {
+				t.Fatalf("expected permission denied, got %v %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestConfigTLSMinVersionInvalid(t *testing.T) {
+	b, storage := testBackend(t)
+	resp, err := testRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{
+		"host":            "https://chef.example.com/",
+		"tls_min_version": "ssl3",
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response, got %v %v", resp, err)
+	}
+}
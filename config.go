@@ -6,32 +6,45 @@ import (
 	"time"
 
 	"fmt"
+	"strings"
 
+	"github.com/go-chef/chef"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// defaultSearchConcurrency is the number of searches evaluated at the same time during a login
+const defaultSearchConcurrency = 8
+
 type config struct {
-	Host            string        `json:"host"`
-	DefaultPolicies []string      `json:"default_policies"`
-	DefaultTTL      time.Duration `json:"default_ttl" structs:"default_ttl" mapstructure:"default_ttl"`
-	DefaultMaxTTL   time.Duration `json:"default_max_ttl" structs:"default_max_ttl" mapstructure:"default_max_ttl"`
-	DefaultPeriod   time.Duration `json:"default_period" structs:"default_period" mapstructure:"default_period"`
+	tokenutil.TokenParams
+
+	Host               string        `json:"host"`
+	ClientName         string        `json:"client_name"`
+	ClientKey          string        `json:"client_key"`
+	CACert             string        `json:"ca_cert"`
+	InsecureSkipVerify bool          `json:"insecure_skip_verify"`
+	TLSServerName      string        `json:"tls_server_name"`
+	TLSMinVersion      string        `json:"tls_min_version"`
+	AliasAttribute     string        `json:"alias_attribute"`
+	RoleResolution     string        `json:"role_resolution"`
+	DefaultPriority    int           `json:"default_priority"`
+	TrustedTagsOnly    bool          `json:"trusted_tags_only"`
+	DefaultCombine     string        `json:"default_combine"`
+	SearchConcurrency  int           `json:"search_concurrency"`
+	SearchTimeout      time.Duration `json:"search_timeout"`
+	DefaultPolicies    []string      `json:"default_policies"`
+	DefaultTTL         time.Duration `json:"default_ttl" structs:"default_ttl" mapstructure:"default_ttl"`
+	DefaultMaxTTL      time.Duration `json:"default_max_ttl" structs:"default_max_ttl" mapstructure:"default_max_ttl"`
+	DefaultPeriod      time.Duration `json:"default_period" structs:"default_period" mapstructure:"default_period"`
 }
 
 func pathConfig(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "config$",
-		Fields: map[string]*framework.FieldSchema{
-			"host": {
-				Type:        framework.TypeString,
-				Description: "Host must be a host string, a host:port pair, or a URL to the base of the Chef server.",
-			},
-			"default_policies": {
-				Type:        framework.TypeStringSlice,
-				Description: "The default list of policies assigned to every maching policy/role.",
-			},
-		},
+		Fields:  configFields(),
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.UpdateOperation: b.pathConfigWrite,
 			logical.CreateOperation: b.pathConfigWrite,
@@ -40,15 +53,144 @@ func pathConfig(b *backend) *framework.Path {
 	}
 }
 
+// configFields returns the config fields, token_* fields apply to nodes matching no policy nor role,
+// except token_policies which are assigned to every node.
+func configFields() map[string]*framework.FieldSchema {
+	fields := map[string]*framework.FieldSchema{
+		"host": {
+			Type:        framework.TypeString,
+			Description: "Host must be a host string, a host:port pair, or a URL to the base of the Chef server.",
+		},
+		"default_policies": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: tokenutil.DeprecationText("token_policies"),
+			Deprecated:  true,
+		},
+		"client_name": {
+			Type:        framework.TypeString,
+			Description: "The name of the Chef client used by Vault for node reads, public key lookups and searches. Node keys are then only used to prove their identity.",
+		},
+		"client_key": {
+			Type:        framework.TypeString,
+			Description: "The private key of the client_name Chef client. It is seal wrapped and never returned.",
+		},
+		"ca_cert": {
+			Type:        framework.TypeString,
+			Description: "PEM encoded CA bundle used to verify the Chef server certificate. Defaults to the system CAs.",
+		},
+		"insecure_skip_verify": {
+			Type:        framework.TypeBool,
+			Default:     false,
+			Description: "Disable the verification of the Chef server certificate. Never use it in production.",
+		},
+		"tls_server_name": {
+			Type:        framework.TypeString,
+			Description: "The server name used for SNI and to verify the Chef server certificate, when it differs from the host.",
+		},
+		"tls_min_version": {
+			Type:        framework.TypeString,
+			Default:     "tls12",
+			Description: "The minimum TLS version accepted from the Chef server: tls10, tls11, tls12 or tls13.",
+		},
+		"role_resolution": {
+			Type:        framework.TypeString,
+			Default:     roleResolutionFirst,
+			Description: "How nodes matching several roles are resolved: first (the first role of the node run list), union (every matched role, merged) or highest_priority (the matched role with the highest priority).",
+		},
+		"default_priority": {
+			Type:        framework.TypeInt,
+			Description: "The priority of the default mapping, made of the token_* fields, when evaluated with the other mappings matched by a node.",
+		},
+		"default_combine": {
+			Type:        framework.TypeString,
+			Default:     combineExclusive,
+			Description: "How the default mapping is combined with the other mappings matched by a node: additive, exclusive or override.",
+		},
+		"trusted_tags_only": {
+			Type:        framework.TypeBool,
+			Default:     false,
+			Description: "Only match tag mappings against the tags set in the attributes of the node roles and environment instead of the node normal tags. Nodes can't set these tags, but they can claim any role or environment in their node object. Requires client_name and client_key.",
+		},
+		"search_concurrency": {
+			Type:        framework.TypeInt,
+			Default:     defaultSearchConcurrency,
+			Description: "The maximum number of searches evaluated on the Chef server at the same time during a login.",
+		},
+		"search_timeout": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long a login waits for the searches evaluated on the Chef server. Defaults to the request deadline.",
+		},
+		"alias_attribute": {
+			Type:        framework.TypeString,
+			Description: "The node field the entity alias is named after: name (default), chef_environment, policy_name or policy_group. Node attributes are not accepted since nodes report them themselves.",
+		},
+	}
+	tokenutil.AddTokenFields(fields)
+	return fields
+}
+
 func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	policies := d.Get("default_policies").([]string)
 	host := d.Get("host").(string)
 	if host == "" {
 		return logical.ErrorResponse("no host provided"), nil
 	}
+	clientName := d.Get("client_name").(string)
+	clientKey := d.Get("client_key").(string)
+	if (clientName == "") != (clientKey == "") {
+		return logical.ErrorResponse("client_name and client_key must be provided together"), nil
+	}
+	if clientKey != "" {
+		if _, err := chef.PrivateKeyFromString([]byte(clientKey)); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid client_key: %s", err)), nil
+		}
+	}
 	config := &config{
-		Host:            host,
-		DefaultPolicies: policies,
+		Host:               host,
+		ClientName:         clientName,
+		ClientKey:          clientKey,
+		CACert:             d.Get("ca_cert").(string),
+		InsecureSkipVerify: d.Get("insecure_skip_verify").(bool),
+		TLSServerName:      d.Get("tls_server_name").(string),
+		TLSMinVersion:      d.Get("tls_min_version").(string),
+		AliasAttribute:     d.Get("alias_attribute").(string),
+		RoleResolution:     d.Get("role_resolution").(string),
+		DefaultPriority:    d.Get("default_priority").(int),
+		DefaultCombine:     d.Get("default_combine").(string),
+		TrustedTagsOnly:    d.Get("trusted_tags_only").(bool),
+		SearchConcurrency:  d.Get("search_concurrency").(int),
+		SearchTimeout:      time.Duration(d.Get("search_timeout").(int)) * time.Second,
+	}
+	if config.AliasAttribute != "" && !strutil.StrListContains(aliasAttributes, config.AliasAttribute) {
+		return logical.ErrorResponse(fmt.Sprintf("alias_attribute must be one of %s", strings.Join(aliasAttributes, ", "))), nil
+	}
+	if config.SearchConcurrency < 1 {
+		return logical.ErrorResponse("search_concurrency must be at least 1"), nil
+	}
+	if config.SearchTimeout < 0 {
+		return logical.ErrorResponse("search_timeout can't be negative"), nil
+	}
+	if config.TrustedTagsOnly && !config.hasClient() {
+		return logical.ErrorResponse("trusted_tags_only requires client_name and client_key"), nil
+	}
+	if !strutil.StrListContains(combineModes, config.DefaultCombine) {
+		return logical.ErrorResponse(fmt.Sprintf("default_combine must be one of %s", strings.Join(combineModes, ", "))), nil
+	}
+	if !strutil.StrListContains(roleResolutions, config.RoleResolution) {
+		return logical.ErrorResponse(fmt.Sprintf("role_resolution must be one of %s", strings.Join(roleResolutions, ", "))), nil
+	}
+	if _, err := config.tlsConfig(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := config.ParseTokenFields(req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenParams(&config.TokenParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if _, ok := d.GetOk("token_policies"); !ok {
+		if policies, ok := d.GetOk("default_policies"); ok {
+			config.TokenPolicies = policies.([]string)
+		}
 	}
 	entry, err := logical.StorageEntryJSON("config", config)
 	if err != nil {
@@ -69,26 +211,82 @@ func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, d *f
 	b.RLock()
 	defer b.RUnlock()
 
-	raw, err := req.Storage.Get(ctx, "config")
+	conf, err := b.getConfigFromStorage(ctx, req)
 	if err != nil {
-		b.Logger().Error("error occured while fetching chef host config: %s", err)
+		b.Logger().Error("error occured while fetching chef host config", "error", err)
 		return logical.ErrorResponse(fmt.Sprintf("Error while fetching config : %s", err)), err
 	}
+	if conf == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"host":                 conf.Host,
+			"client_name":          conf.ClientName,
+			"ca_cert":              conf.CACert,
+			"insecure_skip_verify": conf.InsecureSkipVerify,
+			"tls_server_name":      conf.TLSServerName,
+			"tls_min_version":      conf.TLSMinVersion,
+			"alias_attribute":      conf.AliasAttribute,
+			"role_resolution":      conf.roleResolution(),
+			"default_priority":     conf.DefaultPriority,
+			"default_combine":      conf.defaultCombine(),
+			"trusted_tags_only":    conf.TrustedTagsOnly,
+			"search_concurrency":   conf.searchConcurrency(),
+			"search_timeout":       int64(conf.SearchTimeout.Seconds()),
+		},
+	}
+	conf.PopulateTokenData(resp.Data)
+	resp.Data["default_policies"] = resp.Data["token_policies"]
+
+	return resp, nil
+}
+
+// getConfigFromStorage returns the stored config, or nil if the backend has not been configured yet.
+// Callers are expected to hold the backend lock.
+func (b *backend) getConfigFromStorage(ctx context.Context, req *logical.Request) (*config, error) {
+	raw, err := req.Storage.Get(ctx, "config")
+	if err != nil {
+		return nil, err
+	}
 	if raw == nil {
 		return nil, nil
 	}
 	conf := &config{}
 	if err := json.Unmarshal(raw.Value, conf); err != nil {
 		return nil, err
-	} else if conf == nil {
-		return nil, nil
-	} else {
-		resp := &logical.Response{
-			Data: map[string]interface{}{
-				"host": conf.Host,
-			},
-		}
+	}
+	upgradeTokenParams(&conf.TokenParams, conf.DefaultPolicies, conf.DefaultTTL, conf.DefaultMaxTTL, conf.DefaultPeriod)
+	return conf, nil
+}
 
-		return resp, nil
+// roleResolution returns the role resolution mode, configs stored before it existed using the first role.
+func (c *config) roleResolution() string {
+	if c.RoleResolution == "" {
+		return roleResolutionFirst
 	}
+	return c.RoleResolution
+}
+
+// defaultCombine returns how the default mapping is combined, configs stored before it existed using exclusive.
+func (c *config) defaultCombine() string {
+	if c.DefaultCombine == "" {
+		return combineExclusive
+	}
+	return c.DefaultCombine
+}
+
+// searchConcurrency returns the number of searches evaluated at the same time, configs stored before it existed
+// using the default.
+func (c *config) searchConcurrency() int {
+	if c.SearchConcurrency < 1 {
+		return defaultSearchConcurrency
+	}
+	return c.SearchConcurrency
+}
+
+// hasClient reports whether Vault has its own Chef client for server-side lookups.
+func (c *config) hasClient() bool {
+	return c.ClientName != "" && c.ClientKey != ""
 }
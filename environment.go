@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// ChefEnvironment represent a chef Environment that will be matched against the node chef_environment
+type ChefEnvironment struct {
+	tokenutil.TokenParams
+	mappingParams
+
+	Name string `json:"name" structs:"name" mapstructure:"name"`
+}
+
+func pathEnvironment(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "environment/",
+			Fields:  map[string]*framework.FieldSchema{},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathEnvironmentList,
+			},
+			ExistenceCheck:  nil,
+			HelpSynopsis:    "List all environments configured",
+			HelpDescription: "List all environments configured",
+		},
+		{
+			Pattern: "environment/" + framework.GenericNameRegex("name"),
+			Fields:  environmentFields(),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathEnvironmentRead,
+				logical.CreateOperation: b.pathEnvironmentUpdateOrCreate,
+				logical.UpdateOperation: b.pathEnvironmentUpdateOrCreate,
+				logical.DeleteOperation: b.pathEnvironmentDelete,
+			},
+			ExistenceCheck:  b.pathEnvironmentExistenceCheck,
+			HelpSynopsis:    "CRUD operations on a single environment",
+			HelpDescription: "Let you read, update, create or delete a single environment.",
+		},
+	}
+
+}
+
+func environmentFields() map[string]*framework.FieldSchema {
+	fields := mappingTokenFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeNameString,
+		Description: "The name of the chef environment.",
+	}
+	addMappingFields(fields, combineAdditive)
+	return fields
+}
+
+func (b *backend) getEnvironmentEntryFromStorage(ctx context.Context, r *logical.Request, name string) (*ChefEnvironment, error) {
+	if name == "" {
+		b.Logger().Warn("empty name passed in getEnvironmentEntryFromStorage")
+		return nil, fmt.Errorf("environment's <name> is empty")
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+
+	raw, err := r.Storage.Get(ctx, "environment/"+strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	environment := &ChefEnvironment{}
+	if err := json.Unmarshal(raw.Value, environment); err != nil {
+		return nil, err
+	}
+	return environment, nil
+}
+
+func (b *backend) pathEnvironmentExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	name := d.Get("name").(string)
+
+	p, err := b.getEnvironmentEntryFromStorage(ctx, req, name)
+	return p != nil, err
+}
+
+func (b *backend) pathEnvironmentUpdateOrCreate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	var err error
+	var e *ChefEnvironment
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+	if req.Operation == logical.UpdateOperation {
+		e, err = b.getEnvironmentEntryFromStorage(ctx, req, name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		e = &ChefEnvironment{
+			Name: name,
+		}
+	}
+
+	if err := parseMappingTokenFields(&e.TokenParams, req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenParams(&e.TokenParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := e.parseMappingFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if e.TokenTTL == 0 && e.TokenPeriod == 0 {
+		return nil, fmt.Errorf("you must provide either token_period or token_ttl")
+	}
+
+	if e.TokenPeriod != 0 {
+		e.TokenMaxTTL = 0
+		e.TokenTTL = 0
+	} else if e.TokenMaxTTL < e.TokenTTL {
+		if e.TokenMaxTTL != 0 {
+			return nil, fmt.Errorf("token_max_ttl should always be left zero or be higher than token_ttl")
+		}
+		e.TokenMaxTTL = e.TokenTTL
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	entry, err := logical.StorageEntryJSON("environment/"+strings.ToLower(name), e)
+	if err != nil {
+		return nil, err
+	}
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) pathEnvironmentRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+
+	environment, err := b.getEnvironmentEntryFromStorage(ctx, req, name)
+	if err != nil {
+		return nil, err
+	} else if environment == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name": environment.Name,
+		},
+	}
+	populateMappingTokenData(&environment.TokenParams, resp.Data)
+	environment.populateMappingData(resp.Data, combineAdditive)
+
+	return resp, nil
+}
+
+func (b *backend) pathEnvironmentList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	environments, err := req.Storage.List(ctx, "environment/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(environments), nil
+}
+
+func (b *backend) pathEnvironmentDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing environment name"), nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if err := req.Storage.Delete(ctx, "environment/"+strings.ToLower(name)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
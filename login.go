@@ -4,15 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 
-	"encoding/json"
-
 	"github.com/go-chef/chef"
+	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// loginMethodKey is recorded in the token internal data of nodes which logged in with their private key
+const loginMethodKey = "key"
+
 func pathLogin(b *backend) []*framework.Path {
 	fields := map[string]*framework.FieldSchema{
 		"node_name": {
@@ -23,6 +29,30 @@ func pathLogin(b *backend) []*framework.Path {
 			Type:        framework.TypeString,
 			Description: "The private key, can be often found at /etc/chef/client.pem.",
 		},
+		"timestamp": {
+			Type:        framework.TypeString,
+			Description: "The RFC3339 timestamp included in the signed login payload.",
+		},
+		"nonce": {
+			Type:        framework.TypeString,
+			Description: "The nonce issued by login/challenge and included in the signed login payload.",
+		},
+		"signature": {
+			Type:        framework.TypeString,
+			Description: "The base64 encoded RSA SHA256 signature of the login payload, made with the node's private key. Used instead of private_key.",
+		},
+		"headers": {
+			Type:        framework.TypeHeader,
+			Description: "The X-Ops headers computed by the node for GET /nodes/<node_name>. Used instead of private_key.",
+		},
+		"method": {
+			Type:        framework.TypeString,
+			Description: "The HTTP method the headers were computed for, must be GET.",
+		},
+		"path": {
+			Type:        framework.TypeString,
+			Description: "The path the headers were computed for, with the node name URL escaped as sent to the Chef server, checked against the expected node path.",
+		},
 	}
 	callbks := map[logical.Operation]framework.OperationFunc{
 		logical.UpdateOperation: b.pathAuthLogin,
@@ -32,6 +62,7 @@ func pathLogin(b *backend) []*framework.Path {
 		Fields:    fields,
 		Callbacks: callbks,
 	},
+		pathChallenge(b),
 		{
 			Pattern:   "login/" + framework.GenericNameRegex("node_name"),
 			Fields:    fields,
@@ -45,164 +76,440 @@ func (b *backend) Login(ctx context.Context, req *logical.Request, nodeName, pri
 
 	l.Info("login attempt", "node_name", nodeName)
 
+	// The lock is not held during the Chef requests, the mappings are read under their own lock
 	b.RLock()
-	defer b.RUnlock()
-
-	raw, err := req.Storage.Get(ctx, "config")
+	conf, err := b.getConfigFromStorage(ctx, req)
+	b.RUnlock()
 	if err != nil {
 		l.Error("error occured while get chef host config", "error", err)
 		return logical.ErrorResponse(fmt.Sprintf("Error while fetching config : %s", err)), err
 	}
 
-	if raw == nil {
+	if conf == nil {
 		l.Warn("clients should not use an unconfigured backend.")
 		return logical.ErrorResponse("no host configured"), nil
 	}
 
-	conf := &config{}
-	if err := json.Unmarshal(raw.Value, conf); err != nil {
-		return nil, err
-	}
-
-	client, err := chef.NewClient(&chef.Config{
-		Name:    nodeName,
-		Key:     privateKey,
-		BaseURL: conf.Host,
-		SkipSSL: true,
-		Timeout: 10,
-	})
+	client, err := newChefClient(conf, nodeName, privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	node, err := client.Nodes.Get(nodeName)
+	node, err := client.getNode(ctx, nodeName)
 	if err != nil {
 		l.Error("error occured while authentication chef host with", "host", conf.Host, "error", err)
 		return nil, logical.ErrPermissionDenied
 	}
 
-	var auth *logical.Auth
+	internalData := map[string]interface{}{"login_method": loginMethodKey}
 
-	var chefPolicy *ChefPolicy
-	if err != nil {
-		l.Error("error while fetching chef policy list from storage", "error", err)
-		return nil, err
+	// The node's key only proves its identity, the node ACLs must not influence what it is granted
+	if conf.hasClient() {
+		adminClient, err := newAdminChefClient(conf)
+		if err != nil {
+			return nil, err
+		}
+		return b.authorizeAsAdmin(ctx, req, l, conf, adminClient, nodeName, internalData)
+	}
+
+	return b.authorize(ctx, req, l, conf, client, &node, internalData)
+}
+
+// authorize maps an authenticated node to the policies granted by the stored policies, roles and searches.
+// client is used for every further Chef request and internalData is attached to the resulting token.
+func (b *backend) authorize(ctx context.Context, req *logical.Request, l log.Logger, conf *config, client *chefClient, node *chef.Node, internalData map[string]interface{}) (*logical.Response, error) {
+	var err error
+	nodeName := node.Name
+
+	auth := &logical.Auth{
+		DisplayName:  nodeName,
+		Metadata:     map[string]string{"node_name": nodeName},
+		GroupAliases: []*logical.Alias{},
+		InternalData: internalData,
 	}
+
+	grants := []*grant{}
+
 	if node.PolicyName != "" {
 		chefPolicies, err := b.getPolicyList(ctx, req)
-		l = l.With("policy", node.PolicyName)
+		if err != nil {
+			l.Error("error while fetching chef policy list from storage", "error", err)
+			return nil, err
+		}
 		for _, p := range chefPolicies {
-			if p == node.PolicyName {
-				chefPolicy, err = b.getPolicyEntryFromStorage(ctx, req, p)
-				if err != nil {
-					l.Error("error while fetching chef policy from storage", "policy", p, "error", err)
-					return nil, err
-				}
-				if chefPolicy == nil {
-					l.Error("can't fetch a listed chef policy in storage", "policy", p)
-					return nil, fmt.Errorf("cannot fetch chef policy %s from storage backend", p)
-				}
-				auth = &logical.Auth{
-					DisplayName:  nodeName,
-					LeaseOptions: logical.LeaseOptions{TTL: chefPolicy.TTL, MaxTTL: chefPolicy.MaxTTL, Renewable: true},
-					Period:       chefPolicy.Period,
-					Policies:     append(chefPolicy.VaultPolicies, "default"),
-					Metadata:     map[string]string{"policy": chefPolicy.Name, "node_name": nodeName},
-					GroupAliases: []*logical.Alias{
-						{
-							Name: "policy-" + chefPolicy.Name,
-						},
-					},
-					InternalData: map[string]interface{}{"private_key": privateKey},
-				}
+			if p != node.PolicyName {
+				continue
+			}
+			chefPolicy, err := b.getPolicyEntryFromStorage(ctx, req, p)
+			if err != nil {
+				l.Error("error while fetching chef policy from storage", "policy", p, "error", err)
+				return nil, err
+			}
+			if chefPolicy == nil {
+				l.Error("can't fetch a listed chef policy in storage", "policy", p)
+				return nil, fmt.Errorf("cannot fetch chef policy %s from storage backend", p)
+			}
+			if !chefPolicy.allowsGroup(node.PolicyGroup) {
+				l.Warn("node policy group is not allowed by the chef policy", "policy", p, "policy_group", node.PolicyGroup)
 				break
 			}
+			grants = append(grants, &grant{
+				kind:     kindPolicy,
+				name:     chefPolicy.Name,
+				priority: chefPolicy.Priority,
+				combine:  chefPolicy.combineOr(combineExclusive),
+				params:   chefPolicy.tokenParamsForGroup(node.PolicyGroup),
+			})
+			break
 		}
-	} else if nodeRolesNames := node.AutomaticAttributes["roles"].([]interface{}); nodeRolesNames != nil && len(nodeRolesNames) > 0 {
-		nodeRoles := make([]string, 0, len(nodeRolesNames))
-		chefRoles, err := b.getRoleList(ctx, req)
+	}
+
+	nodeRoles := nodeRoles(node)
+	if len(nodeRoles) > 0 {
+		chefRoles, err := b.matchingRoles(ctx, req, l, nodeRoles)
 		if err != nil {
 			return nil, err
 		}
-		for _, nRaw := range nodeRolesNames {
-
-			roleName, ok := nRaw.(string)
-			if !ok {
-				return nil, fmt.Errorf("Can't serialize role name %+v into a string", nRaw)
-			}
-			nodeRoles = append(nodeRoles, roleName)
-		}
-		auth, err = func() (*logical.Auth, error) {
-			for _, r := range nodeRoles {
-				for _, cr := range chefRoles {
-
-					if r == cr {
-						l = l.With("role", r)
-						chefRole, err := b.getRoleEntryFromStorage(ctx, req, r)
-						if err != nil {
-							l.Error("error while fetching chef role from storage", "role", r, "error", err)
-							return nil, err
-						}
-						if chefRole == nil {
-							l.Error("can't fetch a listed chef role in storage", "role", r)
-							return nil, fmt.Errorf("cannot fetch chef role %s from storage backend", r)
-						}
-						auth := &logical.Auth{
-							DisplayName:  nodeName,
-							LeaseOptions: logical.LeaseOptions{TTL: chefRole.TTL, MaxTTL: chefRole.MaxTTL, Renewable: true},
-							Period:       chefRole.Period,
-							Policies:     append(chefRole.VaultPolicies, "default"),
-							Metadata:     map[string]string{"role": chefRole.Name, "node_name": nodeName},
-							GroupAliases: []*logical.Alias{},
-							InternalData: map[string]interface{}{"private_key": privateKey},
-						}
-						// n is usually between 1 or 5, it's ok to loop again
-						for _, r := range nodeRoles {
-							auth.GroupAliases = append(auth.GroupAliases, &logical.Alias{Name: "role" + r})
-						}
-						return auth, nil
+		if len(chefRoles) > 0 {
+			chefRole := chefRoles[0]
+			if conf.roleResolution() == roleResolutionHighestPriority {
+				for _, r := range chefRoles[1:] {
+					if r.Priority > chefRole.Priority {
+						chefRole = r
 					}
 				}
 			}
-			return nil, nil
-		}()
+			params := chefRole.TokenParams
+			if conf.roleResolution() == roleResolutionUnion {
+				for _, r := range chefRoles[1:] {
+					mergeTokenParams(&params, &r.TokenParams)
+				}
+			}
+			grants = append(grants, &grant{
+				kind:     kindRole,
+				name:     chefRole.Name,
+				priority: chefRole.Priority,
+				combine:  chefRole.combineOr(combineExclusive),
+				params:   &params,
+			})
+			matched := make([]string, 0, len(chefRoles))
+			for _, r := range chefRoles {
+				matched = append(matched, r.Name)
+			}
+			auth.Metadata["chef-matched-roles"] = strings.Join(matched, ",")
+		}
+	}
+
+	if recipes := nodeRecipes(node); len(recipes) > 0 {
+		chefRecipes, err := b.matchingRecipes(ctx, req, l, recipes)
 		if err != nil {
 			return nil, err
 		}
+		matched := make([]string, 0, len(chefRecipes))
+		for _, r := range chefRecipes {
+			matched = append(matched, r.Name)
+			grants = append(grants, &grant{
+				kind:     kindRecipe,
+				name:     r.Name,
+				priority: r.Priority,
+				combine:  r.combineOr(combineAdditive),
+				params:   &r.TokenParams,
+			})
+		}
+		if len(matched) > 0 {
+			auth.Metadata["chef-matched-recipes"] = strings.Join(matched, ",")
+		}
 	}
 
-	// default login
-	if auth == nil {
-		auth = &logical.Auth{
-			DisplayName:  nodeName,
-			LeaseOptions: logical.LeaseOptions{TTL: conf.DefaultTTL, MaxTTL: conf.DefaultMaxTTL, Renewable: true},
-			Period:       conf.DefaultPeriod,
-			Policies:     []string{"default"},
-			Metadata:     map[string]string{"node_name": nodeName},
-			GroupAliases: []*logical.Alias{},
-			InternalData: map[string]interface{}{"private_key": privateKey},
+	tags, err := b.trustedTags(ctx, conf, client, node, nodeRoles)
+	if err != nil {
+		l.Error("error while fetching the trusted tags of the node", "error", err)
+		return nil, err
+	}
+	if len(tags) > 0 {
+		matched := []string{}
+		for _, tag := range tags {
+			chefTag, err := b.getTagEntryFromStorage(ctx, req, tag)
+			if err != nil {
+				l.Error("error while fetching chef tag from storage", "tag", tag, "error", err)
+				return nil, err
+			}
+			if chefTag == nil {
+				continue
+			}
+			matched = append(matched, chefTag.Name)
+			grants = append(grants, &grant{
+				kind:     kindTag,
+				name:     chefTag.Name,
+				priority: chefTag.Priority,
+				combine:  chefTag.combineOr(combineAdditive),
+				params:   &chefTag.TokenParams,
+			})
+		}
+		if len(matched) > 0 {
+			auth.Metadata["chef-matched-tags"] = strings.Join(matched, ",")
 		}
 	}
 
-	if len(conf.DefaultPolicies) > 0 {
-		auth.Policies = append(auth.Policies, conf.DefaultPolicies...)
+	chefRules, err := b.matchingRules(ctx, req, l, node)
+	if err != nil {
+		return nil, err
+	}
+	if len(chefRules) > 0 {
+		matched := make([]string, 0, len(chefRules))
+		for _, r := range chefRules {
+			matched = append(matched, r.Name)
+			grants = append(grants, &grant{
+				kind:     kindRule,
+				name:     r.Name,
+				priority: r.Priority,
+				combine:  r.combineOr(combineAdditive),
+				params:   &r.TokenParams,
+			})
+		}
+		auth.Metadata["chef-matched-rules"] = strings.Join(matched, ",")
+	}
+
+	if node.Environment != "" {
+		chefEnvironment, err := b.getEnvironmentEntryFromStorage(ctx, req, node.Environment)
+		if err != nil {
+			l.Error("error while fetching chef environment from storage", "environment", node.Environment, "error", err)
+			return nil, err
+		}
+		if chefEnvironment != nil {
+			grants = append(grants, &grant{
+				kind:     kindEnvironment,
+				name:     chefEnvironment.Name,
+				priority: chefEnvironment.Priority,
+				combine:  chefEnvironment.combineOr(combineAdditive),
+				params:   &chefEnvironment.TokenParams,
+			})
+		}
 	}
 
-	policies, searches, err := b.MatchingSearches(req, client)
+	searches, warnings, err := b.MatchingSearches(ctx, req, conf, client, node)
 	if err != nil {
 		l.Error(fmt.Sprintf("error while fetching matched searches: %s", err))
 		return nil, err
 	}
 	if len(searches) > 0 {
-		auth.Metadata["chef-matched-searches"] = strings.Join(searches, ",")
+		names := make([]string, 0, len(searches))
+		for _, s := range searches {
+			names = append(names, s.Name)
+			grants = append(grants, &grant{
+				kind:     kindSearch,
+				name:     s.Name,
+				priority: s.Priority,
+				combine:  s.combineOr(combineAdditive),
+				params:   &tokenutil.TokenParams{TokenPolicies: s.Policies, TokenType: s.TokenType},
+			})
+		}
+		auth.Metadata["chef-matched-searches"] = strings.Join(names, ",")
+	}
+
+	// default login
+	grants = append(grants, &grant{
+		kind:     kindDefault,
+		name:     kindDefault,
+		priority: conf.DefaultPriority,
+		combine:  conf.defaultCombine(),
+		params:   &conf.TokenParams,
+	})
+
+	params, applied := evaluateGrants(grants)
+	params.PopulateTokenAuth(auth)
+	// The config token_policies are given to every node
+	auth.Policies = strutil.RemoveDuplicates(append(auth.Policies, conf.TokenPolicies...), false)
+
+	appliedNames := make([]string, 0, len(applied))
+	for _, g := range applied {
+		appliedNames = append(appliedNames, g.kind+"/"+g.name)
+		switch g.kind {
+		case kindPolicy:
+			auth.Metadata["policy"] = g.name
+			auth.Metadata["policy_group"] = node.PolicyGroup
+			auth.GroupAliases = append(auth.GroupAliases, &logical.Alias{Name: "policy-" + g.name})
+		case kindRole:
+			auth.Metadata["role"] = g.name
+			// n is usually between 1 or 5, it's ok to loop again
+			for _, r := range nodeRoles {
+				auth.GroupAliases = append(auth.GroupAliases, &logical.Alias{Name: "role" + r})
+			}
+		case kindEnvironment:
+			auth.Metadata["environment"] = g.name
+			auth.GroupAliases = append(auth.GroupAliases, &logical.Alias{Name: "environment-" + g.name})
+		}
 	}
-	if len(policies) > 0 {
-		auth.Policies = append(auth.Policies, policies...)
+	auth.Metadata["chef-applied-mappings"] = strings.Join(appliedNames, ",")
+	l = l.With("mappings", auth.Metadata["chef-applied-mappings"])
+
+	auth.Alias, err = nodeAlias(conf, node)
+	if err != nil {
+		l.Error("can't build the entity alias", "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := validateTokenAuth(auth); err != nil {
+		l.Error("invalid token settings", "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if auth.TokenType == logical.TokenTypeBatch {
+		auth.Renewable = false
+	} else if !conf.hasClient() {
+		// Node keys are not retained, tokens can only be renewed with the configured client
+		l.Warn("issuing a non-renewable token since client_name and client_key are not configured")
+		auth.Renewable = false
+		warnings = append(warnings, "the token is not renewable since client_name and client_key are not configured")
 	}
 
 	l.Info("login successful", "node_name", nodeName)
 
-	return &logical.Response{Auth: auth}, nil
+	return &logical.Response{Auth: auth, Warnings: warnings}, nil
+}
+
+// aliasAttributes are the top-level node fields entity aliases can be named after. Node attributes are not
+// allowed: nodes report them themselves, so a node could claim the alias of another node.
+var aliasAttributes = []string{"name", "chef_environment", "policy_name", "policy_group"}
+
+// nodeAlias returns the entity alias of a node, named after the node or its alias_attribute.
+func nodeAlias(conf *config, node *chef.Node) (*logical.Alias, error) {
+	var name string
+	switch conf.AliasAttribute {
+	case "", "name":
+		name = node.Name
+	case "chef_environment":
+		name = node.Environment
+	case "policy_name":
+		name = node.PolicyName
+	case "policy_group":
+		name = node.PolicyGroup
+	default:
+		// Configs stored before alias_attribute was restricted may hold an attribute path
+		return nil, fmt.Errorf("alias_attribute %s is not supported anymore, it must be one of %s", conf.AliasAttribute, strings.Join(aliasAttributes, ", "))
+	}
+	if name == "" {
+		return nil, fmt.Errorf("alias attribute %s is empty on the node", conf.AliasAttribute)
+	}
+
+	return &logical.Alias{
+		Name: name,
+		Metadata: map[string]string{
+			"node_name":        node.Name,
+			"chef_environment": node.Environment,
+			"policy_name":      node.PolicyName,
+			"policy_group":     node.PolicyGroup,
+			"roles":            strings.Join(nodeRoles(node), ","),
+		},
+	}, nil
+}
+
+// matchingRoles returns the stored roles of the node, in the order of its run list.
+func (b *backend) matchingRoles(ctx context.Context, req *logical.Request, l log.Logger, nodeRoles []string) ([]*ChefRole, error) {
+	chefRoles, err := b.getRoleList(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	matched := []*ChefRole{}
+	for _, r := range nodeRoles {
+		if !strutil.StrListContains(chefRoles, r) {
+			continue
+		}
+		chefRole, err := b.getRoleEntryFromStorage(ctx, req, r)
+		if err != nil {
+			l.Error("error while fetching chef role from storage", "role", r, "error", err)
+			return nil, err
+		}
+		if chefRole == nil {
+			l.Error("can't fetch a listed chef role in storage", "role", r)
+			return nil, fmt.Errorf("cannot fetch chef role %s from storage backend", r)
+		}
+		matched = append(matched, chefRole)
+	}
+	return matched, nil
+}
+
+// trustedTags returns the tags of the node mappings can be matched against. With trusted_tags_only, these are
+// the tags set in the attributes of the node roles and environment, fetched with the configured client, since
+// nodes can modify their own normal attributes. The roles and environment still come from the node object, so a
+// node can claim the tags of any role or environment.
+func (b *backend) trustedTags(ctx context.Context, conf *config, client *chefClient, node *chef.Node, nodeRoles []string) ([]string, error) {
+	if !conf.TrustedTagsOnly {
+		return strutil.RemoveDuplicates(nodeTags(node), false), nil
+	}
+	if !conf.hasClient() {
+		return nil, nil
+	}
+
+	tags := []string{}
+	for _, r := range nodeRoles {
+		role, err := client.getRole(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, attributeTags(role.DefaultAttributes)...)
+		tags = append(tags, attributeTags(role.OverrideAttributes)...)
+	}
+	if node.Environment != "" {
+		env, err := client.getEnvironment(ctx, node.Environment)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, attributeTags(env.DefaultAttributes)...)
+		tags = append(tags, attributeTags(env.OverrideAttributes)...)
+	}
+	return strutil.RemoveDuplicates(tags, false), nil
+}
+
+// matchingRules returns the stored rules met by the node attributes.
+func (b *backend) matchingRules(ctx context.Context, req *logical.Request, l log.Logger, node *chef.Node) ([]*ChefRule, error) {
+	names, err := b.getRuleList(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	attrs := nodeAttributes(node)
+	matched := []*ChefRule{}
+	for _, name := range names {
+		chefRule, err := b.getRuleEntryFromStorage(ctx, req, name)
+		if err != nil {
+			l.Error("error while fetching rule from storage", "rule", name, "error", err)
+			return nil, err
+		}
+		if chefRule == nil {
+			l.Error("can't fetch a listed rule in storage", "rule", name)
+			return nil, fmt.Errorf("cannot fetch rule %s from storage backend", name)
+		}
+		if chefRule.matches(attrs) {
+			matched = append(matched, chefRule)
+		}
+	}
+	return matched, nil
+}
+
+// matchingRecipes returns the stored recipe patterns matching one of the node recipes.
+func (b *backend) matchingRecipes(ctx context.Context, req *logical.Request, l log.Logger, recipes []string) ([]*ChefRecipe, error) {
+	patterns, err := b.getRecipeList(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	matched := []*ChefRecipe{}
+	for _, p := range patterns {
+		chefRecipe, err := b.getRecipeEntryFromStorage(ctx, req, p)
+		if err != nil {
+			l.Error("error while fetching chef recipe from storage", "recipe", p, "error", err)
+			return nil, err
+		}
+		if chefRecipe == nil {
+			l.Error("can't fetch a listed chef recipe in storage", "recipe", p)
+			return nil, fmt.Errorf("cannot fetch chef recipe %s from storage backend", p)
+		}
+		if chefRecipe.matches(recipes) {
+			matched = append(matched, chefRecipe)
+		}
+	}
+	return matched, nil
 }
 
 func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -211,9 +518,25 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 		return logical.ErrorResponse("no node name provided"), nil
 	}
 
+	if signature := d.Get("signature").(string); signature != "" {
+		timestamp := d.Get("timestamp").(string)
+		if timestamp == "" {
+			return logical.ErrorResponse("no timestamp provided"), nil
+		}
+		nonce := d.Get("nonce").(string)
+		if nonce == "" {
+			return logical.ErrorResponse("no nonce provided"), nil
+		}
+		return b.SignedLogin(ctx, req, nodeName, timestamp, nonce, signature)
+	}
+
+	if headers := d.Get("headers").(http.Header); len(headers) > 0 {
+		return b.HeadersLogin(ctx, req, nodeName, headers, d.Get("method").(string), d.Get("path").(string))
+	}
+
 	privateKey := d.Get("private_key").(string)
 	if privateKey == "" {
-		return logical.ErrorResponse("no private key provided"), nil
+		return logical.ErrorResponse("no private key, signature or headers provided"), nil
 	}
 
 	return b.Login(ctx, req, nodeName, privateKey)
@@ -224,21 +547,56 @@ func (b *backend) pathAuthRenew(ctx context.Context, req *logical.Request, d *fr
 		return nil, errors.New("request auth was nil")
 	}
 
-	b.Logger().Debug("received a renew request for %s", req.Auth.DisplayName)
+	b.Logger().Debug("received a renew request", "display_name", req.Auth.DisplayName)
 
 	nodeName := req.Auth.Metadata["node_name"]
 	if nodeName == "" {
 		return logical.ErrorResponse("no node name provided"), nil
 	}
 
-	privateKeyRaw, ok := req.Auth.InternalData["private_key"]
-	var privateKey string
-	if ok {
-		privateKey = privateKeyRaw.(string)
+	b.RLock()
+	conf, err := b.getConfigFromStorage(ctx, req)
+	b.RUnlock()
+	if err != nil {
+		return nil, err
 	}
-	if privateKey == "" {
-		return logical.ErrorResponse("no private key found"), nil
+	if conf == nil {
+		return logical.ErrorResponse("no host configured"), nil
 	}
 
-	return b.Login(ctx, req, nodeName, privateKey)
+	if req.Auth.TokenType == logical.TokenTypeBatch {
+		return logical.ErrorResponse("batch tokens cannot be renewed"), nil
+	}
+
+	method, _ := req.Auth.InternalData["login_method"].(string)
+	privateKey, _ := req.Auth.InternalData["private_key"].(string)
+
+	var resp *logical.Response
+	if conf.hasClient() {
+		resp, err = b.AdminLogin(ctx, req, nodeName, map[string]interface{}{"login_method": method})
+	} else if privateKey != "" {
+		// Tokens issued before node keys stopped being retained can still renew with it
+		resp, err = b.Login(ctx, req, nodeName, privateKey)
+	} else {
+		return logical.ErrorResponse("renewal requires client_name and client_key to be configured"), nil
+	}
+	if err != nil || resp == nil || resp.IsError() {
+		return resp, err
+	}
+
+	// Vault lowercases the token policies, the granted ones are compared the same way
+	granted := policyutil.SanitizePolicies(resp.Auth.Policies, false)
+	if !policyutil.EquivalentPolicies(granted, policyutil.SanitizePolicies(req.Auth.TokenPolicies, false)) {
+		return logical.ErrorResponse("policies granted to the node have changed, not renewing"), nil
+	}
+
+	renewed := &logical.Response{Auth: req.Auth}
+	// Tokens issued before node keys stopped being retained drop it once renewed with the configured client
+	if conf.hasClient() {
+		delete(renewed.Auth.InternalData, "private_key")
+	}
+	renewed.Auth.TTL = resp.Auth.TTL
+	renewed.Auth.MaxTTL = resp.Auth.MaxTTL
+	renewed.Auth.Period = resp.Auth.Period
+	return renewed, nil
 }
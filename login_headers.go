@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// loginMethodHeaders is recorded in the token internal data of nodes which logged in with forwarded X-Ops headers
+const loginMethodHeaders = "headers"
+
+// forwardedHeaders are the headers copied from the login request to the Chef request, along with every X-Ops-Authorization-N
+var forwardedHeaders = []string{
+	"X-Ops-Sign",
+	"X-Ops-Userid",
+	"X-Ops-Timestamp",
+	"X-Ops-Content-Hash",
+	"X-Chef-Version",
+	"X-Ops-Server-Api-Version",
+}
+
+// HeadersLogin authenticates a node by replaying the X-Ops headers it computed for GET /nodes/<node_name>.
+// A successful answer from the Chef server proves the node holds its key, without the key reaching Vault.
+func (b *backend) HeadersLogin(ctx context.Context, req *logical.Request, nodeName string, headers http.Header, method, signedPath string) (*logical.Response, error) {
+	l := b.Logger().With("node_name", nodeName, "request", req.ID)
+
+	l.Info("headers login attempt", "node_name", nodeName)
+
+	if method != "" && strings.ToUpper(method) != "GET" {
+		return logical.ErrorResponse("headers must be computed for a GET request"), nil
+	}
+	if userID := headers.Get("X-Ops-Userid"); userID != nodeName {
+		return logical.ErrorResponse(fmt.Sprintf("X-Ops-Userid %q does not match node name", userID)), nil
+	}
+	if headers.Get("X-Ops-Sign") == "" {
+		return logical.ErrorResponse("missing X-Ops-Sign header"), nil
+	}
+	if headers.Get("X-Ops-Content-Hash") != chef.HashStr("") {
+		return logical.ErrorResponse("X-Ops-Content-Hash must be the hash of an empty body"), nil
+	}
+	authorization := opsAuthorization(headers)
+	if len(authorization) == 0 {
+		return logical.ErrorResponse("missing X-Ops-Authorization headers"), nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, headers.Get("X-Ops-Timestamp"))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid X-Ops-Timestamp: %s", err)), nil
+	}
+	if skew := time.Since(ts); skew > maxClockSkew || skew < -maxClockSkew {
+		l.Warn("X-Ops-Timestamp is outside of the allowed window", "timestamp", ts)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	b.RLock()
+	conf, err := b.getConfigFromStorage(ctx, req)
+	b.RUnlock()
+	if err != nil {
+		l.Error("error occured while get chef host config", "error", err)
+		return logical.ErrorResponse(fmt.Sprintf("Error while fetching config : %s", err)), err
+	}
+	if conf == nil {
+		l.Warn("clients should not use an unconfigured backend.")
+		return logical.ErrorResponse("no host configured"), nil
+	}
+
+	client, err := newAdminChefClient(conf)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("headers login is not available: %s", err)), nil
+	}
+
+	u, err := client.resolve("nodes/" + url.PathEscape(nodeName))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid node name: %s", err)), nil
+	}
+	expectedPath := path.Clean(u.EscapedPath())
+	if signedPath != "" && path.Clean(signedPath) != expectedPath {
+		return logical.ErrorResponse(fmt.Sprintf("headers must be computed for path %s", expectedPath)), nil
+	}
+
+	chefReq, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	chefReq.Header.Set("Accept", "application/json")
+	for _, h := range forwardedHeaders {
+		if v := headers.Get(h); v != "" {
+			chefReq.Header.Set(h, v)
+		}
+	}
+	for i, v := range authorization {
+		chefReq.Header.Set(fmt.Sprintf("X-Ops-Authorization-%d", i+1), v)
+	}
+
+	// The request already carries the node signature, it is sent as is instead of being signed by the client
+	var node chef.Node
+	if err := client.send(chefReq, &node); err != nil {
+		l.Error("error occured while authentication chef host with", "host", conf.Host, "error", err)
+		return nil, logical.ErrPermissionDenied
+	}
+	if node.Name != nodeName {
+		l.Error("chef server returned an unexpected node", "returned", node.Name)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	// The same headers must not be used twice, even within the timestamp window. They are only recorded once the
+	// Chef server accepted them, so unauthenticated requests can't fill the ledger.
+	digest := sha256.Sum256([]byte(strings.Join(authorization, "")))
+	if err := b.recordNonce(ctx, req, hex.EncodeToString(digest[:]), nodeName, ts.Add(maxClockSkew)); err != nil {
+		l.Warn("rejected replayed headers", "error", err)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	return b.authorize(ctx, req, l, conf, client, &node, map[string]interface{}{"login_method": loginMethodHeaders})
+}
+
+// opsAuthorization returns the X-Ops-Authorization-N header values, in order.
+func opsAuthorization(headers http.Header) []string {
+	values := []string{}
+	for i := 1; ; i++ {
+		v := headers.Get(fmt.Sprintf("X-Ops-Authorization-%d", i))
+		if v == "" {
+			return values
+		}
+		values = append(values, v)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// nodeHeaders returns the X-Ops headers computed by a node for GET /nodes/<target>, along with the path sent.
+func nodeHeaders(t *testing.T, api *chefAPI, nodeName, target string) (http.Header, string) {
+	c, err := chef.NewClient(&chef.Config{Name: nodeName, Key: testPrivateKey(t), BaseURL: api.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := c.NewRequest("GET", "nodes/"+url.PathEscape(target), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req.Header, req.URL.EscapedPath()
+}
+
+func headersData(nodeName string, headers http.Header, path string) map[string]interface{} {
+	h := map[string]interface{}{}
+	for k, v := range headers {
+		h[k] = v[0]
+	}
+	data := map[string]interface{}{"node_name": nodeName, "headers": h}
+	if path != "" {
+		data["path"] = path
+	}
+	return data
+}
+
+// nodeLoginData returns the login data of nodeName with the headers computed by signer for GET /nodes/<target>.
+func nodeLoginData(t *testing.T, api *chefAPI, nodeName, signer, target string) map[string]interface{} {
+	headers, path := nodeHeaders(t, api, signer, target)
+	return headersData(nodeName, headers, path)
+}
+
+func TestHeadersLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodeName string
+		// data returns the login data
+		data func(t *testing.T, api *chefAPI) map[string]interface{}
+		// denied is whether the login is denied, instead of rejected with an error response
+		ok, denied bool
+	}{
+		{
+			name:     "valid headers",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				return nodeLoginData(t, api, "node1", "node1", "node1")
+			},
+			ok: true,
+		},
+		{
+			name:     "escaped node name",
+			nodeName: "web 1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				return nodeLoginData(t, api, "web 1", "web 1", "web 1")
+			},
+			ok: true,
+		},
+		{
+			name:     "path of another node",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, _ := nodeHeaders(t, api, "node1", "node1")
+				return headersData("node1", headers, "/nodes/node2")
+			},
+		},
+		{
+			name:     "headers computed for another node",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, _ := nodeHeaders(t, api, "node1", "node2")
+				return headersData("node1", headers, "")
+			},
+			denied: true,
+		},
+		{
+			name:     "headers of another user",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				return nodeLoginData(t, api, "node1", "node2", "node1")
+			},
+		},
+		{
+			name:     "missing X-Ops-Sign",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, p := nodeHeaders(t, api, "node1", "node1")
+				headers.Del("X-Ops-Sign")
+				return headersData("node1", headers, p)
+			},
+		},
+		{
+			name:     "missing X-Ops-Authorization",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, p := nodeHeaders(t, api, "node1", "node1")
+				headers.Del("X-Ops-Authorization-1")
+				return headersData("node1", headers, p)
+			},
+		},
+		{
+			name:     "malformed X-Ops-Authorization",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, p := nodeHeaders(t, api, "node1", "node1")
+				headers.Set("X-Ops-Authorization-1", "not a signature")
+				return headersData("node1", headers, p)
+			},
+			denied: true,
+		},
+		{
+			name:     "missing X-Ops-Timestamp",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, p := nodeHeaders(t, api, "node1", "node1")
+				headers.Del("X-Ops-Timestamp")
+				return headersData("node1", headers, p)
+			},
+		},
+		{
+			name:     "malformed X-Ops-Timestamp",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, p := nodeHeaders(t, api, "node1", "node1")
+				headers.Set("X-Ops-Timestamp", "yesterday")
+				return headersData("node1", headers, p)
+			},
+		},
+		{
+			name:     "X-Ops-Timestamp outside of the window",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, p := nodeHeaders(t, api, "node1", "node1")
+				headers.Set("X-Ops-Timestamp", time.Now().Add(-maxClockSkew-time.Minute).UTC().Format(time.RFC3339))
+				return headersData("node1", headers, p)
+			},
+			denied: true,
+		},
+		{
+			name:     "X-Ops-Content-Hash of a body",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				headers, p := nodeHeaders(t, api, "node1", "node1")
+				headers.Set("X-Ops-Content-Hash", chef.HashStr("{}"))
+				return headersData("node1", headers, p)
+			},
+		},
+		{
+			name:     "POST method",
+			nodeName: "node1",
+			data: func(t *testing.T, api *chefAPI) map[string]interface{} {
+				data := nodeLoginData(t, api, "node1", "node1", "node1")
+				data["method"] = "POST"
+				return data
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage, api := testSignedLoginSetup(t)
+			api.addClient("web 1", testRSAKey(t, 0))
+			api.set("/nodes/web 1", chefNode("web 1"))
+
+			resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", tt.data(t, api))
+			switch {
+			case tt.ok:
+				if err != nil || resp == nil || resp.Auth == nil {
+					t.Fatalf("expected login to succeed, got %v %v", resp, err)
+				}
+				if resp.Auth.Metadata["node_name"] != tt.nodeName {
+					t.Errorf("logged in as %s", resp.Auth.Metadata["node_name"])
+				}
+			case tt.denied:
+				if err != logical.ErrPermissionDenied {
+					t.Fatalf("expected permission denied, got %v %v", resp, err)
+				}
+			default:
+				if err != nil || resp == nil || !resp.IsError() {
+					t.Fatalf("expected an error response, got %v %v", resp, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadersLoginReplay(t *testing.T) {
+	b, storage, api := testSignedLoginSetup(t)
+	data := nodeLoginData(t, api, "node1", "node1", "node1")
+
+	resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", data)
+	if err != nil || resp == nil || resp.Auth == nil {
+		t.Fatalf("expected login to succeed, got %v %v", resp, err)
+	}
+	resp, err = testRequest(t, b, storage, logical.UpdateOperation, "login", data)
+	if err != logical.ErrPermissionDenied {
+		t.Fatalf("expected the replayed headers to be denied, got %v %v", resp, err)
+	}
+}
+
+func TestHeadersLoginRejectedNotRecorded(t *testing.T) {
+	b, storage, api := testSignedLoginSetup(t)
+	headers, p := nodeHeaders(t, api, "node1", "node1")
+	headers.Set("X-Ops-Authorization-1", "not a signature")
+
+	if _, err := testRequest(t, b, storage, logical.UpdateOperation, "login", headersData("node1", headers, p)); err != logical.ErrPermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	keys, err := storage.List(context.Background(), "nonce/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("headers rejected by the Chef server were recorded: %v", keys)
+	}
+}
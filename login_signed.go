@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// loginMethodSigned is recorded in the token internal data of nodes which logged in with a signature
+	loginMethodSigned = "signed"
+	// maxClockSkew is the maximum accepted difference between a signed timestamp and Vault's clock
+	maxClockSkew = 5 * time.Minute
+)
+
+// signedLoginPayload returns the string a node must sign with its client key to login without sending it.
+func signedLoginPayload(nodeName, timestamp, nonce string) string {
+	return fmt.Sprintf("vault-auth-chef\nnode_name:%s\ntimestamp:%s\nnonce:%s", nodeName, timestamp, nonce)
+}
+
+// SignedLogin authenticates a node that signed the login payload with its client key.
+// The node's public key and node object are fetched with the configured client, so the node's key never reaches Vault.
+func (b *backend) SignedLogin(ctx context.Context, req *logical.Request, nodeName, timestamp, nonce, signature string) (*logical.Response, error) {
+	l := b.Logger().With("node_name", nodeName, "request", req.ID)
+
+	l.Info("signed login attempt", "node_name", nodeName)
+
+	ts, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid timestamp: %s", err)), nil
+	}
+	if skew := time.Since(ts); skew > maxClockSkew || skew < -maxClockSkew {
+		l.Warn("signed login timestamp is outside of the allowed window", "timestamp", timestamp)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid signature encoding: %s", err)), nil
+	}
+
+	b.RLock()
+	conf, err := b.getConfigFromStorage(ctx, req)
+	b.RUnlock()
+	if err != nil {
+		l.Error("error occured while get chef host config", "error", err)
+		return logical.ErrorResponse(fmt.Sprintf("Error while fetching config : %s", err)), err
+	}
+	if conf == nil {
+		l.Warn("clients should not use an unconfigured backend.")
+		return logical.ErrorResponse("no host configured"), nil
+	}
+
+	client, err := newAdminChefClient(conf)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("signed login is not available: %s", err)), nil
+	}
+
+	pub, err := clientPublicKey(ctx, client, nodeName)
+	if err != nil {
+		l.Error("error occured while fetching the public key of the node", "host", conf.Host, "error", err)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	digest := sha256.Sum256([]byte(signedLoginPayload(nodeName, timestamp, nonce)))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		l.Warn("invalid login signature", "error", err)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	if err := b.consumeNonce(ctx, req, nonce, nodeName); err != nil {
+		l.Warn("rejected login nonce", "nonce", nonce, "error", err)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	return b.authorizeAsAdmin(ctx, req, l, conf, client, nodeName, map[string]interface{}{"login_method": loginMethodSigned})
+}
+
+// AdminLogin authorizes a node using only the configured client, without any proof from the node itself.
+// It must only be used for nodes that already proved their identity, i.e. on token renewal.
+func (b *backend) AdminLogin(ctx context.Context, req *logical.Request, nodeName string, internalData map[string]interface{}) (*logical.Response, error) {
+	l := b.Logger().With("node_name", nodeName, "request", req.ID)
+
+	b.RLock()
+	conf, err := b.getConfigFromStorage(ctx, req)
+	b.RUnlock()
+	if err != nil {
+		l.Error("error occured while get chef host config", "error", err)
+		return logical.ErrorResponse(fmt.Sprintf("Error while fetching config : %s", err)), err
+	}
+	if conf == nil {
+		return logical.ErrorResponse("no host configured"), nil
+	}
+
+	client, err := newAdminChefClient(conf)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	return b.authorizeAsAdmin(ctx, req, l, conf, client, nodeName, internalData)
+}
+
+func (b *backend) authorizeAsAdmin(ctx context.Context, req *logical.Request, l log.Logger, conf *config, client *chefClient, nodeName string, internalData map[string]interface{}) (*logical.Response, error) {
+	node, err := client.getNode(ctx, nodeName)
+	if err != nil {
+		l.Error("error occured while fetching node", "host", conf.Host, "error", err)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	return b.authorize(ctx, req, l, conf, client, &node, internalData)
+}
+
+// clientPublicKey fetches the public key of a Chef client, falling back on the keys endpoint for Chef servers
+// which do not return it with the client object.
+func clientPublicKey(ctx context.Context, client *chefClient, name string) (*rsa.PublicKey, error) {
+	c, err := client.getClient(ctx, name)
+	if err == nil {
+		if c.PublicKey != "" {
+			return parsePublicKey(c.PublicKey)
+		}
+		if c.Certificate != "" {
+			return parsePublicKey(c.Certificate)
+		}
+	}
+
+	key, keyErr := client.getClientKey(ctx, name, "default")
+	if keyErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, keyErr
+	}
+	return parsePublicKey(key.PublicKey)
+}
+
+// parsePublicKey parses a PEM encoded RSA public key, as PKIX, PKCS1 or wrapped in a certificate.
+func parsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in public key")
+	}
+
+	var pub interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			pub = cert.PublicKey
+		}
+	default:
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+	return rsaPub, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testSignedLoginSetup returns a backend configured with an admin client against a Chef server knowing node1,
+// whose key is the first test key.
+func testSignedLoginSetup(t *testing.T) (*backend, logical.Storage, *chefAPI) {
+	api := newChefAPI(t)
+	api.addClient("vault", testRSAKey(t, 1))
+	api.addClient("node1", testRSAKey(t, 0))
+	api.set("/nodes/node1", chefNode("node1"))
+	api.set("/clients/node1", map[string]interface{}{"name": "node1", "public_key": publicKeyPEM(t, testRSAKey(t, 0))})
+
+	b, storage := testBackend(t)
+	testWrite(t, b, storage, "config", map[string]interface{}{
+		"host":        api.URL + "/",
+		"client_name": "vault",
+		"client_key":  privateKeyPEM(testRSAKey(t, 1)),
+	})
+	return b, storage, api
+}
+
+func testChallenge(t *testing.T, b *backend, storage logical.Storage, nodeName string) string {
+	t.Helper()
+	resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login/challenge", map[string]interface{}{"node_name": nodeName})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("requesting a challenge: %v %v", resp, err)
+	}
+	return resp.Data["nonce"].(string)
+}
+
+func signLoginPayload(t *testing.T, k *rsa.PrivateKey, nodeName, timestamp, nonce string) string {
+	digest := sha256.Sum256([]byte(signedLoginPayload(nodeName, timestamp, nonce)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestSignedLogin(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name string
+		// sign returns the timestamp sent and the signature of the payload
+		sign func(t *testing.T, nonce string) (string, string)
+		ok   bool
+	}{
+		{
+			name: "valid signature",
+			sign: func(t *testing.T, nonce string) (string, string) {
+				return now, signLoginPayload(t, testRSAKey(t, 0), "node1", now, nonce)
+			},
+			ok: true,
+		},
+		{
+			name: "wrong key",
+			sign: func(t *testing.T, nonce string) (string, string) {
+				return now, signLoginPayload(t, testRSAKey(t, 2), "node1", now, nonce)
+			},
+		},
+		{
+			name: "tampered timestamp",
+			sign: func(t *testing.T, nonce string) (string, string) {
+				other := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+				return other, signLoginPayload(t, testRSAKey(t, 0), "node1", now, nonce)
+			},
+		},
+		{
+			name: "tampered node name",
+			sign: func(t *testing.T, nonce string) (string, string) {
+				return now, signLoginPayload(t, testRSAKey(t, 0), "node2", now, nonce)
+			},
+		},
+		{
+			name: "timestamp too old",
+			sign: func(t *testing.T, nonce string) (string, string) {
+				old := time.Now().Add(-maxClockSkew - time.Minute).UTC().Format(time.RFC3339)
+				return old, signLoginPayload(t, testRSAKey(t, 0), "node1", old, nonce)
+			},
+		},
+		{
+			name: "timestamp in the future",
+			sign: func(t *testing.T, nonce string) (string, string) {
+				future := time.Now().Add(maxClockSkew + time.Minute).UTC().Format(time.RFC3339)
+				return future, signLoginPayload(t, testRSAKey(t, 0), "node1", future, nonce)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage, _ := testSignedLoginSetup(t)
+			nonce := testChallenge(t, b, storage, "node1")
+			timestamp, signature := tt.sign(t, nonce)
+
+			resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+				"node_name": "node1",
+				"timestamp": timestamp,
+				"nonce":     nonce,
+				"signature": signature,
+			})
+			if tt.ok && (err != nil || resp == nil || resp.Auth == nil) {
+				t.Fatalf("expected login to succeed, got %v %v", resp, err)
+			}
+			if !tt.ok && err != logical.ErrPermissionDenied {
+				t.Fatalf("expected permission denied, got %v %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestSignedLoginKeysFallback(t *testing.T) {
+	for name, client := range map[string]interface{}{
+		"client without public key": map[string]interface{}{"name": "node1"},
+		"client not readable":       nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, storage, api := testSignedLoginSetup(t)
+			api.set("/clients/node1", client)
+			api.set("/clients/node1/keys/default", map[string]interface{}{
+				"name":            "default",
+				"public_key":      publicKeyPEM(t, testRSAKey(t, 0)),
+				"expiration_date": "infinity",
+			})
+
+			nonce := testChallenge(t, b, storage, "node1")
+			now := time.Now().UTC().Format(time.RFC3339)
+			resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+				"node_name": "node1",
+				"timestamp": now,
+				"nonce":     nonce,
+				"signature": signLoginPayload(t, testRSAKey(t, 0), "node1", now, nonce),
+			})
+			if err != nil || resp == nil || resp.Auth == nil {
+				t.Fatalf("expected login to succeed, got %v %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestSignedLoginWithoutPublicKey(t *testing.T) {
+	b, storage, api := testSignedLoginSetup(t)
+	api.set("/clients/node1", nil)
+
+	nonce := testChallenge(t, b, storage, "node1")
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+		"node_name": "node1",
+		"timestamp": now,
+		"nonce":     nonce,
+		"signature": signLoginPayload(t, testRSAKey(t, 0), "node1", now, nonce),
+	})
+	if err != logical.ErrPermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRenew(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is applied between the login and the renewal
+		change func(t *testing.T, b *backend, storage logical.Storage, api *chefAPI)
+		ok     bool
+	}{
+		{
+			name:   "same policies",
+			change: func(t *testing.T, b *backend, storage logical.Storage, api *chefAPI) {},
+			ok:     true,
+		},
+		{
+			name: "changed policies",
+			change: func(t *testing.T, b *backend, storage logical.Storage, api *chefAPI) {
+				testWrite(t, b, storage, "role/web", map[string]interface{}{"token_policies": "other-secrets", "token_ttl": 3600})
+			},
+		},
+		{
+			name: "deleted node",
+			change: func(t *testing.T, b *backend, storage logical.Storage, api *chefAPI) {
+				api.set("/nodes/node1", nil)
+			},
+		},
+	}
+
+	for mode, adminClient := range map[string]bool{"admin client": true, "legacy private key": false} {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				api := newChefAPI(t)
+				api.addClient("vault", testRSAKey(t, 1))
+				api.addClient("node1", testRSAKey(t, 0))
+				api.set("/nodes/node1", chefNode("node1", "web"))
+
+				b, storage := testBackend(t)
+				conf := map[string]interface{}{"host": api.URL + "/"}
+				if adminClient {
+					conf["client_name"] = "vault"
+					conf["client_key"] = privateKeyPEM(testRSAKey(t, 1))
+				}
+				testWrite(t, b, storage, "config", conf)
+				// Vault lowercases the policies of the tokens it issues
+				testWrite(t, b, storage, "role/web", map[string]interface{}{"token_policies": "Web-Secrets", "token_ttl": 3600})
+
+				resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+					"node_name":   "node1",
+					"private_key": testPrivateKey(t),
+				})
+				if err != nil || resp == nil || resp.Auth == nil {
+					t.Fatalf("expected login to succeed, got %v %v", resp, err)
+				}
+				auth := resp.Auth
+				auth.TokenPolicies = policyutil.SanitizePolicies(auth.Policies, policyutil.AddDefaultPolicy)
+				if !adminClient {
+					// Tokens issued before node keys stopped being retained
+					auth.InternalData["private_key"] = testPrivateKey(t)
+				}
+
+				tt.change(t, b, storage, api)
+
+				resp, err = b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.RenewOperation,
+					Path:      "login",
+					Storage:   storage,
+					Auth:      auth,
+				})
+				if tt.ok {
+					if err != nil || resp == nil || resp.IsError() || resp.Auth == nil {
+						t.Fatalf("expected the renewal to succeed, got %v %v", resp, err)
+					}
+					if _, ok := resp.Auth.InternalData["private_key"]; ok && adminClient {
+						t.Error("the private key was kept in the renewed token")
+					}
+					return
+				}
+				if err == nil && (resp == nil || !resp.IsError()) {
+					t.Fatalf("expected the renewal to fail, got %v", resp)
+				}
+			})
+		}
+	}
+}
+
+func TestLoginDoesNotLockDuringChefRequests(t *testing.T) {
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-release
+		nodeHandler("node1")(w, r)
+	}))
+	defer srv.Close()
+
+	b, storage := testBackend(t)
+	testWrite(t, b, storage, "config", map[string]interface{}{"host": srv.URL + "/"})
+
+	done := make(chan error)
+	go func() {
+		_, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+			"node_name":   "node1",
+			"private_key": testPrivateKey(t),
+		})
+		done <- err
+	}()
+	<-requested
+
+	// Mappings can be written while the login waits for the Chef server
+	written := make(chan error)
+	go func() {
+		_, err := testRequest(t, b, storage, logical.CreateOperation, "recipe/nginx", map[string]interface{}{"token_policies": "web", "token_ttl": 3600})
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		// A login holding the lock deadlocks with the waiting write on its next read of the mappings
+		close(release)
+		t.Fatal("the write waited for the login")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
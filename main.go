@@ -4,6 +4,7 @@ import (
 	"context"
 	stdlog "log"
 	"os"
+	"strings"
 	"sync"
 
 	log "github.com/hashicorp/go-hclog"
@@ -42,17 +43,25 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 type backend struct {
 	*framework.Backend
 	sync.RWMutex
-	SearchStore *sync.Map
+	searchCache    *searchCache
+	ruleConditions ruleConditionCache
+	nonceLock      sync.Mutex
+	pendingNonces  pendingNonces
 }
 
 // Backend is the factory for our backend
 func Backend(_ *logical.BackendConfig) *backend {
 	var b backend
 
-	b.SearchStore = &sync.Map{}
+	b.searchCache = newSearchCache(func(msg string, args ...interface{}) {
+		b.Logger().Error(msg, args...)
+	})
 	b.Backend = &framework.Backend{
-		BackendType: logical.TypeCredential,
-		AuthRenew:   b.pathAuthRenew,
+		BackendType:  logical.TypeCredential,
+		Clean:        b.clean,
+		Invalidate:   b.invalidate,
+		AuthRenew:    b.pathAuthRenew,
+		PeriodicFunc: b.periodicFunc,
 		PathsSpecial: &logical.Paths{
 			Unauthenticated: []string{"login*"},
 			SealWrapStorage: []string{"config"},
@@ -64,6 +73,10 @@ func Backend(_ *logical.BackendConfig) *backend {
 			pathLogin(&b),
 			pathRole(&b),
 			pathPolicy(&b),
+			pathEnvironment(&b),
+			pathRecipe(&b),
+			pathTag(&b),
+			pathRule(&b),
 			pathSearch(&b),
 		),
 	}
@@ -75,3 +88,30 @@ func Backend(_ *logical.BackendConfig) *backend {
 
 	return &b
 }
+
+func (b *backend) clean(ctx context.Context) {
+	b.searchCache.stop()
+}
+
+// invalidate drops the cached result of a search when it, or its stored result, is changed by another Vault node,
+// and the cached conditions of a rule changed by another Vault node
+func (b *backend) invalidate(ctx context.Context, key string) {
+	switch {
+	case strings.HasPrefix(key, "rule/"):
+		b.ruleConditions.forget(strings.TrimPrefix(key, "rule/"))
+	case strings.HasPrefix(key, "search/"):
+		b.searchCache.invalidate(strings.TrimPrefix(key, "search/"))
+	case strings.HasPrefix(key, searchCachePrefix):
+		b.searchCache.invalidate(strings.TrimPrefix(key, searchCachePrefix))
+	}
+}
+
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if err := b.tidyNonces(ctx, req); err != nil {
+		b.Logger().Error("error while removing expired nonces", "error", err)
+	}
+	if err := b.refreshSearches(ctx, req); err != nil {
+		b.Logger().Error("error while refreshing cached searches", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+)
+
+const (
+	// combineAdditive grants are merged on top of the other applied grants
+	combineAdditive = "additive"
+	// combineExclusive grants exclude each other, only the first one in evaluation order applies
+	combineExclusive = "exclusive"
+	// combineOverride grants replace every other grant
+	combineOverride = "override"
+)
+
+var combineModes = []string{combineAdditive, combineExclusive, combineOverride}
+
+// Mapping kinds, in the order used to break priority ties
+const (
+	kindPolicy      = "policy"
+	kindRole        = "role"
+	kindRecipe      = "recipe"
+	kindTag         = "tag"
+	kindRule        = "rule"
+	kindEnvironment = "environment"
+	kindSearch      = "search"
+	kindDefault     = "default"
+)
+
+var kindOrder = []string{kindPolicy, kindRole, kindRecipe, kindTag, kindRule, kindEnvironment, kindSearch, kindDefault}
+
+// mappingParams holds how a mapping is combined with the other mappings matched by a node
+type mappingParams struct {
+	Priority int    `json:"priority" structs:"priority" mapstructure:"priority"`
+	Combine  string `json:"combine" structs:"combine" mapstructure:"combine"`
+}
+
+// addMappingFields adds the priority and combine fields, described with the default combine mode of the mapping kind.
+func addMappingFields(fields map[string]*framework.FieldSchema, defaultCombine string) {
+	fields["priority"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "The priority of the mapping when a node matches several mappings. Higher is evaluated first.",
+	}
+	fields["combine"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: fmt.Sprintf("How the mapping is combined with the other matched mappings: additive, exclusive or override. Defaults to %s.", defaultCombine),
+	}
+}
+
+// parseMappingFields parses the priority and combine fields.
+func (m *mappingParams) parseMappingFields(d *framework.FieldData) error {
+	if priorityRaw, ok := d.GetOk("priority"); ok {
+		m.Priority = priorityRaw.(int)
+	}
+	if combineRaw, ok := d.GetOk("combine"); ok {
+		combine := combineRaw.(string)
+		if combine != "" && !strutil.StrListContains(combineModes, combine) {
+			return fmt.Errorf("combine must be one of %s", strings.Join(combineModes, ", "))
+		}
+		m.Combine = combine
+	}
+	return nil
+}
+
+// combineOr returns the combine mode of the mapping, or def if it was not set.
+func (m *mappingParams) combineOr(def string) string {
+	if m.Combine == "" {
+		return def
+	}
+	return m.Combine
+}
+
+// populateMappingData adds the priority and combine fields to a read response.
+func (m *mappingParams) populateMappingData(data map[string]interface{}, defaultCombine string) {
+	data["priority"] = m.Priority
+	data["combine"] = m.combineOr(defaultCombine)
+}
+
+// grant is a mapping matched by a node, along with the token settings it grants
+type grant struct {
+	kind     string
+	name     string
+	priority int
+	combine  string
+	params   *tokenutil.TokenParams
+}
+
+// evaluateGrants resolves the grants matched by a node into the token settings to issue.
+// Grants are evaluated by decreasing priority, then kind (in kindOrder), then name:
+// the first override grant is applied alone, otherwise the first exclusive grant is applied and every additive grant
+// is merged on top of it. It returns nil settings when no grant applies, along with the applied grants.
+func evaluateGrants(grants []*grant) (*tokenutil.TokenParams, []*grant) {
+	sorted := make([]*grant, len(grants))
+	copy(sorted, grants)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].priority != sorted[j].priority {
+			return sorted[i].priority > sorted[j].priority
+		}
+		if ki, kj := kindIndex(sorted[i].kind), kindIndex(sorted[j].kind); ki != kj {
+			return ki < kj
+		}
+		return sorted[i].name < sorted[j].name
+	})
+
+	for _, g := range sorted {
+		if g.combine == combineOverride {
+			t := *g.params
+			return &t, []*grant{g}
+		}
+	}
+
+	applied := []*grant{}
+	for _, g := range sorted {
+		if g.combine == combineExclusive {
+			applied = append(applied, g)
+			break
+		}
+	}
+	for _, g := range sorted {
+		if g.combine == combineAdditive {
+			applied = append(applied, g)
+		}
+	}
+	if len(applied) == 0 {
+		return nil, applied
+	}
+
+	t := *applied[0].params
+	for _, g := range applied[1:] {
+		mergeTokenParams(&t, g.params)
+	}
+	return &t, applied
+}
+
+func kindIndex(kind string) int {
+	for i, k := range kindOrder {
+		if k == kind {
+			return i
+		}
+	}
+	return len(kindOrder)
+}
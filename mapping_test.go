@@ -0,0 +1,268 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func testGrant(kind, name string, priority int, combine string, policies ...string) *grant {
+	return &grant{
+		kind:     kind,
+		name:     name,
+		priority: priority,
+		combine:  combine,
+		params:   &tokenutil.TokenParams{TokenPolicies: policies},
+	}
+}
+
+func TestEvaluateGrants(t *testing.T) {
+	tests := []struct {
+		name     string
+		grants   []*grant
+		applied  []string
+		policies []string
+	}{
+		{
+			name:    "no grant",
+			grants:  nil,
+			applied: []string{},
+		},
+		{
+			name: "higher priority first",
+			grants: []*grant{
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+				testGrant(kindRole, "web", 10, combineExclusive, "role"),
+			},
+			applied:  []string{"role/web"},
+			policies: []string{"role"},
+		},
+		{
+			name: "priority tie broken by kind",
+			grants: []*grant{
+				testGrant(kindSearch, "web", 0, combineExclusive, "search"),
+				testGrant(kindRole, "web", 0, combineExclusive, "role"),
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+			},
+			applied:  []string{"policy/web"},
+			policies: []string{"policy"},
+		},
+		{
+			name: "priority and kind tie broken by name",
+			grants: []*grant{
+				testGrant(kindRole, "web", 0, combineExclusive, "web"),
+				testGrant(kindRole, "base", 0, combineExclusive, "base"),
+			},
+			applied:  []string{"role/base"},
+			policies: []string{"base"},
+		},
+		{
+			name: "first override applied alone",
+			grants: []*grant{
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+				testGrant(kindEnvironment, "prod", 0, combineAdditive, "environment"),
+				testGrant(kindSearch, "breakglass", 0, combineOverride, "breakglass"),
+				testGrant(kindRole, "quarantine", 0, combineOverride, "quarantine"),
+			},
+			applied:  []string{"role/quarantine"},
+			policies: []string{"quarantine"},
+		},
+		{
+			name: "first exclusive and every additive",
+			grants: []*grant{
+				testGrant(kindSearch, "monitoring", 0, combineAdditive, "monitoring"),
+				testGrant(kindRole, "web", 0, combineExclusive, "role"),
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+				testGrant(kindEnvironment, "prod", 0, combineAdditive, "environment"),
+			},
+			applied:  []string{"policy/web", "environment/prod", "search/monitoring"},
+			policies: []string{"environment", "monitoring", "policy"},
+		},
+		{
+			name: "additive only",
+			grants: []*grant{
+				testGrant(kindTag, "web", 0, combineAdditive, "tag"),
+				testGrant(kindRecipe, "nginx", 0, combineAdditive, "recipe"),
+			},
+			applied:  []string{"recipe/nginx", "tag/web"},
+			policies: []string{"recipe", "tag"},
+		},
+		{
+			name: "exclusive default after a matched policy",
+			grants: []*grant{
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+				testGrant(kindDefault, kindDefault, 0, combineExclusive, "default"),
+			},
+			applied:  []string{"policy/web"},
+			policies: []string{"policy"},
+		},
+		{
+			name: "exclusive default alone",
+			grants: []*grant{
+				testGrant(kindEnvironment, "prod", 0, combineAdditive, "environment"),
+				testGrant(kindDefault, kindDefault, 0, combineExclusive, "default"),
+			},
+			applied:  []string{"default/default", "environment/prod"},
+			policies: []string{"default", "environment"},
+		},
+		{
+			name: "additive default",
+			grants: []*grant{
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+				testGrant(kindDefault, kindDefault, 0, combineAdditive, "default"),
+			},
+			applied:  []string{"policy/web", "default/default"},
+			policies: []string{"default", "policy"},
+		},
+		{
+			name: "override default",
+			grants: []*grant{
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+				testGrant(kindDefault, kindDefault, 0, combineOverride, "default"),
+			},
+			applied:  []string{"default/default"},
+			policies: []string{"default"},
+		},
+		{
+			name: "default with a higher priority",
+			grants: []*grant{
+				testGrant(kindPolicy, "web", 0, combineExclusive, "policy"),
+				testGrant(kindDefault, kindDefault, 1, combineExclusive, "default"),
+			},
+			applied:  []string{"default/default"},
+			policies: []string{"default"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, applied := evaluateGrants(tt.grants)
+
+			names := []string{}
+			for _, g := range applied {
+				names = append(names, g.kind+"/"+g.name)
+			}
+			if !reflect.DeepEqual(names, tt.applied) {
+				t.Errorf("applied %v, expected %v", names, tt.applied)
+			}
+			if len(tt.applied) == 0 {
+				if params != nil {
+					t.Errorf("expected no token settings, got %+v", params)
+				}
+				return
+			}
+			if !reflect.DeepEqual(params.TokenPolicies, tt.policies) {
+				t.Errorf("policies %v, expected %v", params.TokenPolicies, tt.policies)
+			}
+		})
+	}
+}
+
+func TestEvaluateGrantsDoesNotModifyGrants(t *testing.T) {
+	exclusive := testGrant(kindPolicy, "web", 0, combineExclusive, "policy")
+	additive := testGrant(kindSearch, "monitoring", 0, combineAdditive, "monitoring")
+
+	evaluateGrants([]*grant{additive, exclusive})
+
+	if !reflect.DeepEqual(exclusive.params.TokenPolicies, []string{"policy"}) {
+		t.Errorf("the exclusive grant was modified: %v", exclusive.params.TokenPolicies)
+	}
+}
+
+func TestMergeTokenParams(t *testing.T) {
+	cidrs, err := parseutil.ParseAddrs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCIDRs, err := parseutil.ParseAddrs("192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		t        tokenutil.TokenParams
+		granted  tokenutil.TokenParams
+		expected tokenutil.TokenParams
+	}{
+		{
+			name:     "policies merged",
+			t:        tokenutil.TokenParams{TokenPolicies: []string{"web", "base"}},
+			granted:  tokenutil.TokenParams{TokenPolicies: []string{"base", "monitoring"}},
+			expected: tokenutil.TokenParams{TokenPolicies: []string{"base", "monitoring", "web"}},
+		},
+		{
+			name: "strictest durations",
+			t: tokenutil.TokenParams{
+				TokenPolicies:       []string{},
+				TokenTTL:            time.Hour,
+				TokenMaxTTL:         0,
+				TokenExplicitMaxTTL: 2 * time.Hour,
+				TokenPeriod:         time.Hour,
+			},
+			granted: tokenutil.TokenParams{
+				TokenTTL:            time.Minute,
+				TokenMaxTTL:         time.Hour,
+				TokenExplicitMaxTTL: 0,
+				TokenPeriod:         2 * time.Hour,
+			},
+			expected: tokenutil.TokenParams{
+				TokenPolicies:       []string{},
+				TokenTTL:            time.Minute,
+				TokenMaxTTL:         time.Hour,
+				TokenExplicitMaxTTL: 2 * time.Hour,
+				TokenPeriod:         time.Hour,
+			},
+		},
+		{
+			name:     "smallest use count",
+			t:        tokenutil.TokenParams{TokenPolicies: []string{}, TokenNumUses: 10},
+			granted:  tokenutil.TokenParams{TokenNumUses: 5},
+			expected: tokenutil.TokenParams{TokenPolicies: []string{}, TokenNumUses: 5},
+		},
+		{
+			name:     "unlimited use count",
+			t:        tokenutil.TokenParams{TokenPolicies: []string{}, TokenNumUses: 0},
+			granted:  tokenutil.TokenParams{TokenNumUses: 5},
+			expected: tokenutil.TokenParams{TokenPolicies: []string{}, TokenNumUses: 5},
+		},
+		{
+			name:     "first bound CIDRs kept",
+			t:        tokenutil.TokenParams{TokenPolicies: []string{}, TokenBoundCIDRs: cidrs},
+			granted:  tokenutil.TokenParams{TokenBoundCIDRs: otherCIDRs},
+			expected: tokenutil.TokenParams{TokenPolicies: []string{}, TokenBoundCIDRs: cidrs},
+		},
+		{
+			name:     "bound CIDRs granted",
+			t:        tokenutil.TokenParams{TokenPolicies: []string{}},
+			granted:  tokenutil.TokenParams{TokenBoundCIDRs: otherCIDRs},
+			expected: tokenutil.TokenParams{TokenPolicies: []string{}, TokenBoundCIDRs: otherCIDRs},
+		},
+		{
+			name:     "first explicit token type kept",
+			t:        tokenutil.TokenParams{TokenPolicies: []string{}, TokenType: logical.TokenTypeService},
+			granted:  tokenutil.TokenParams{TokenType: logical.TokenTypeBatch},
+			expected: tokenutil.TokenParams{TokenPolicies: []string{}, TokenType: logical.TokenTypeService},
+		},
+		{
+			name:     "token type granted",
+			t:        tokenutil.TokenParams{TokenPolicies: []string{}},
+			granted:  tokenutil.TokenParams{TokenType: logical.TokenTypeBatch},
+			expected: tokenutil.TokenParams{TokenPolicies: []string{}, TokenType: logical.TokenTypeBatch},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.t
+			mergeTokenParams(&params, &tt.granted)
+			if !reflect.DeepEqual(params, tt.expected) {
+				t.Errorf("got %+v, expected %+v", params, tt.expected)
+			}
+		})
+	}
+}
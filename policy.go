@@ -8,16 +8,26 @@ import (
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 // ChefPolicy represent a chef Policy that will be matched against the node-name runlist
 type ChefPolicy struct {
+	tokenutil.TokenParams
+	mappingParams
+
 	Name          string        `json:"name" structs:"name" mapstructure:"name"`
 	VaultPolicies []string      `json:"policies" structs:"policies" mapstructure:"policies"`
 	TTL           time.Duration `json:"ttl" structs:"ttl" mapstructure:"ttl"`
 	MaxTTL        time.Duration `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
 	Period        time.Duration `json:"period" structs:"period" mapstructure:"period"`
+
+	// PolicyGroups restricts the policy to nodes in these policy groups, when not empty
+	PolicyGroups []string `json:"policy_groups" structs:"policy_groups" mapstructure:"policy_groups"`
+	// GroupOverrides holds, per policy group, the token settings replacing those of the policy
+	GroupOverrides map[string]*tokenutil.TokenParams `json:"group_overrides" structs:"group_overrides" mapstructure:"group_overrides"`
 }
 
 func pathPolicy(b *backend) []*framework.Path {
@@ -34,28 +44,7 @@ func pathPolicy(b *backend) []*framework.Path {
 		},
 		{
 			Pattern: "policy/" + framework.GenericNameRegex("name"),
-			Fields: map[string]*framework.FieldSchema{
-				"name": {
-					Type:        framework.TypeNameString,
-					Description: "The name of the chef policy.",
-				},
-				"policies": {
-					Type:        framework.TypeStringSlice,
-					Description: "The list of vault's policy to assign.",
-				},
-				"ttl": {
-					Type:        framework.TypeDurationSecond,
-					Description: "The TTL of the generated tokens",
-				},
-				"max_ttl": {
-					Type:        framework.TypeDurationSecond,
-					Description: "The Max TTL of the generated tokens",
-				},
-				"period": {
-					Type:        framework.TypeDurationSecond,
-					Description: "The Period of the generated tokens",
-				},
-			},
+			Fields:  policyFields(),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.pathPolicyRead,
 				logical.CreateOperation: b.pathPolicyUpdateOrCreate,
@@ -66,10 +55,25 @@ func pathPolicy(b *backend) []*framework.Path {
 			HelpSynopsis:    "CRUD operations on a single policy",
 			HelpDescription: "Let you read, update, create or delete a single policy.",
 		},
+		pathPolicyGroup(b),
 	}
 
 }
 
+func policyFields() map[string]*framework.FieldSchema {
+	fields := mappingTokenFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeNameString,
+		Description: "The name of the chef policy.",
+	}
+	addMappingFields(fields, combineExclusive)
+	fields["policy_groups"] = &framework.FieldSchema{
+		Type:        framework.TypeCommaStringSlice,
+		Description: "The policy groups allowed to use this policy. Nodes in other groups do not match it. Defaults to every group.",
+	}
+	return fields
+}
+
 func (b *backend) getPolicyEntryFromStorage(ctx context.Context, r *logical.Request, name string) (*ChefPolicy, error) {
 	if name == "" {
 		b.Logger().Warn("empty name passed in getPolicyEntryFromStorage")
@@ -90,6 +94,7 @@ func (b *backend) getPolicyEntryFromStorage(ctx context.Context, r *logical.Requ
 	if err := json.Unmarshal(raw.Value, p); err != nil {
 		return nil, err
 	}
+	upgradeTokenParams(&p.TokenParams, p.VaultPolicies, p.TTL, p.MaxTTL, p.Period)
 	return p, nil
 }
 
@@ -114,52 +119,60 @@ func (b *backend) pathPolicyUpdateOrCreate(ctx context.Context, req *logical.Req
 		}
 	} else {
 		p = &ChefPolicy{
-			Name:          name,
-			VaultPolicies: []string{},
-			TTL:           0,
-			MaxTTL:        0,
-			Period:        0,
+			Name: name,
 		}
 	}
 
-	if policiesRaw, ok := d.GetOk("policies"); ok {
-		p.VaultPolicies = policiesRaw.([]string)
+	if err := parseMappingTokenFields(&p.TokenParams, req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
-
-	if TTLRaw, ok := d.GetOk("ttl"); ok {
-		p.TTL = time.Duration(TTLRaw.(int)) * time.Second
+	if err := validateTokenParams(&p.TokenParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
-
-	if maxTTLRaw, ok := d.GetOk("max_ttl"); ok {
-		p.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+	if err := p.parseMappingFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
-
-	if periodRaw, ok := d.GetOk("period"); ok {
-		p.Period = time.Duration(periodRaw.(int)) * time.Second
+	if groupsRaw, ok := d.GetOk("policy_groups"); ok {
+		// Policy groups are compared case-insensitively, as their overrides are stored lowercased
+		groups := groupsRaw.([]string)
+		for i, g := range groups {
+			groups[i] = strings.ToLower(g)
+		}
+		p.PolicyGroups = strutil.RemoveDuplicatesStable(groups, false)
 	}
 
-	if p.TTL == 0 && p.Period == 0 {
-		return nil, fmt.Errorf("you must provide either period or ttl")
+	if p.TokenTTL == 0 && p.TokenPeriod == 0 {
+		return nil, fmt.Errorf("you must provide either token_period or token_ttl")
 	}
 
-	if p.Period != 0 {
-		p.MaxTTL = 0
-		p.TTL = 0
-	} else if p.MaxTTL < p.TTL {
-		if p.MaxTTL != 0 {
-			return nil, fmt.Errorf("max_ttl should always be left zero or be higher than ttl")
+	if p.TokenPeriod != 0 {
+		p.TokenMaxTTL = 0
+		p.TokenTTL = 0
+	} else if p.TokenMaxTTL < p.TokenTTL {
+		if p.TokenMaxTTL != 0 {
+			return nil, fmt.Errorf("token_max_ttl should always be left zero or be higher than token_ttl")
 		}
-		p.MaxTTL = p.TTL
+		p.TokenMaxTTL = p.TokenTTL
 	}
 
+	// The legacy fields are only kept to read entries stored before the token_* fields
+	p.VaultPolicies = nil
+	p.TTL = 0
+	p.MaxTTL = 0
+	p.Period = 0
+
+	return nil, b.putPolicyEntry(ctx, req, p)
+}
+
+func (b *backend) putPolicyEntry(ctx context.Context, req *logical.Request, p *ChefPolicy) error {
 	b.Lock()
 	defer b.Unlock()
 
-	entry, err := logical.StorageEntryJSON("policy/"+strings.ToLower(name), p)
+	entry, err := logical.StorageEntryJSON("policy/"+strings.ToLower(p.Name), p)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return nil, req.Storage.Put(ctx, entry)
+	return req.Storage.Put(ctx, entry)
 }
 
 func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -177,13 +190,13 @@ func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *f
 
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"policies": policy.VaultPolicies,
-			"name":     policy.Name,
-			"ttl":      policy.TTL.Seconds(),
-			"max_ttl":  policy.MaxTTL.Seconds(),
-			"period":   policy.Period.Seconds(),
+			"name":            policy.Name,
+			"policy_groups":   policy.PolicyGroups,
+			"group_overrides": policy.overriddenGroups(),
 		},
 	}
+	populateMappingTokenData(&policy.TokenParams, resp.Data)
+	policy.populateMappingData(resp.Data, combineExclusive)
 
 	return resp, nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathPolicyGroup(b *backend) *framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeNameString,
+			Description: "The name of the chef policy.",
+		},
+		"group": {
+			Type:        framework.TypeNameString,
+			Description: "The policy group the token settings apply to.",
+		},
+	}
+	tokenutil.AddTokenFields(fields)
+
+	return &framework.Path{
+		Pattern: "policy/" + framework.GenericNameRegex("name") + "/group/" + framework.GenericNameRegex("group"),
+		Fields:  fields,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathPolicyGroupRead,
+			logical.CreateOperation: b.pathPolicyGroupWrite,
+			logical.UpdateOperation: b.pathPolicyGroupWrite,
+			logical.DeleteOperation: b.pathPolicyGroupDelete,
+		},
+		ExistenceCheck:  b.pathPolicyGroupExistenceCheck,
+		HelpSynopsis:    "CRUD operations on the overrides of a policy for a policy group",
+		HelpDescription: "Let you read, update, create or delete the token settings replacing those of a policy for nodes in a policy group. Unset fields are inherited from the policy.",
+	}
+}
+
+// allowsGroup reports whether nodes in the policy group can match the policy, policy groups are case-insensitive.
+func (p *ChefPolicy) allowsGroup(group string) bool {
+	if len(p.PolicyGroups) == 0 {
+		return true
+	}
+	for _, g := range p.PolicyGroups {
+		// Policies stored before policy groups were lowercased may hold mixed case groups
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// overriddenGroups returns the sorted policy groups having overrides.
+func (p *ChefPolicy) overriddenGroups() []string {
+	groups := make([]string, 0, len(p.GroupOverrides))
+	for g := range p.GroupOverrides {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// tokenParamsForGroup returns the token settings of the policy with the override of the policy group applied.
+func (p *ChefPolicy) tokenParamsForGroup(group string) *tokenutil.TokenParams {
+	o, ok := p.GroupOverrides[strings.ToLower(group)]
+	if !ok {
+		t := p.TokenParams
+		return &t
+	}
+	return overrideTokenParams(p.TokenParams, o)
+}
+
+// overrideTokenParams replaces the token settings of t by those set in o.
+func overrideTokenParams(t tokenutil.TokenParams, o *tokenutil.TokenParams) *tokenutil.TokenParams {
+	if len(o.TokenPolicies) > 0 {
+		t.TokenPolicies = o.TokenPolicies
+	}
+	if len(o.TokenBoundCIDRs) > 0 {
+		t.TokenBoundCIDRs = o.TokenBoundCIDRs
+	}
+	if o.TokenPeriod != 0 {
+		t.TokenPeriod = o.TokenPeriod
+		t.TokenTTL = 0
+		t.TokenMaxTTL = 0
+	}
+	if o.TokenTTL != 0 {
+		t.TokenTTL = o.TokenTTL
+		t.TokenPeriod = 0
+	}
+	if o.TokenMaxTTL != 0 {
+		t.TokenMaxTTL = o.TokenMaxTTL
+	}
+	if t.TokenMaxTTL != 0 && t.TokenMaxTTL < t.TokenTTL {
+		t.TokenMaxTTL = t.TokenTTL
+	}
+	if o.TokenExplicitMaxTTL != 0 {
+		t.TokenExplicitMaxTTL = o.TokenExplicitMaxTTL
+	}
+	if o.TokenNumUses != 0 {
+		t.TokenNumUses = o.TokenNumUses
+	}
+	if o.TokenType != logical.TokenTypeDefault {
+		t.TokenType = o.TokenType
+	}
+	if o.TokenNoDefaultPolicy {
+		t.TokenNoDefaultPolicy = true
+	}
+	return &t
+}
+
+func (b *backend) pathPolicyGroupExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	p, err := b.getPolicyEntryFromStorage(ctx, req, d.Get("name").(string))
+	if err != nil || p == nil {
+		return false, err
+	}
+	_, ok := p.GroupOverrides[strings.ToLower(d.Get("group").(string))]
+	return ok, nil
+}
+
+func (b *backend) pathPolicyGroupWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	group := strings.ToLower(d.Get("group").(string))
+	if name == "" || group == "" {
+		return logical.ErrorResponse("missing name or group"), nil
+	}
+
+	p, err := b.getPolicyEntryFromStorage(ctx, req, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse(fmt.Sprintf("policy %s does not exist", name)), nil
+	}
+	if !p.allowsGroup(group) {
+		return logical.ErrorResponse(fmt.Sprintf("policy group %s is not in the policy_groups of policy %s", group, name)), nil
+	}
+
+	o, ok := p.GroupOverrides[group]
+	if !ok {
+		o = &tokenutil.TokenParams{}
+	}
+	if err := o.ParseTokenFields(req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenParams(overrideTokenParams(p.TokenParams, o)); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if p.GroupOverrides == nil {
+		p.GroupOverrides = map[string]*tokenutil.TokenParams{}
+	}
+	p.GroupOverrides[group] = o
+
+	return nil, b.putPolicyEntry(ctx, req, p)
+}
+
+func (b *backend) pathPolicyGroupRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	p, err := b.getPolicyEntryFromStorage(ctx, req, d.Get("name").(string))
+	if err != nil || p == nil {
+		return nil, err
+	}
+	group := strings.ToLower(d.Get("group").(string))
+	o, ok := p.GroupOverrides[group]
+	if !ok {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":  p.Name,
+			"group": group,
+		},
+	}
+	o.PopulateTokenData(resp.Data)
+	return resp, nil
+}
+
+func (b *backend) pathPolicyGroupDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	p, err := b.getPolicyEntryFromStorage(ctx, req, d.Get("name").(string))
+	if err != nil || p == nil {
+		return nil, err
+	}
+	group := strings.ToLower(d.Get("group").(string))
+	if _, ok := p.GroupOverrides[group]; !ok {
+		return nil, nil
+	}
+	delete(p.GroupOverrides, group)
+
+	return nil, b.putPolicyEntry(ctx, req, p)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// ChefRecipe represent a recipe pattern that will be matched against the node expanded run list
+type ChefRecipe struct {
+	tokenutil.TokenParams
+	mappingParams
+
+	Name string `json:"name" structs:"name" mapstructure:"name"`
+}
+
+func pathRecipe(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "recipe/",
+			Fields:  map[string]*framework.FieldSchema{},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathRecipeList,
+			},
+			ExistenceCheck:  nil,
+			HelpSynopsis:    "List all recipes configured",
+			HelpDescription: "List all recipes configured",
+		},
+		{
+			Pattern: "recipe/" + recipePatternRegex("name"),
+			Fields:  recipeFields(),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathRecipeRead,
+				logical.CreateOperation: b.pathRecipeUpdateOrCreate,
+				logical.UpdateOperation: b.pathRecipeUpdateOrCreate,
+				logical.DeleteOperation: b.pathRecipeDelete,
+			},
+			ExistenceCheck:  b.pathRecipeExistenceCheck,
+			HelpSynopsis:    "CRUD operations on a single recipe",
+			HelpDescription: "Let you read, update, create or delete a single recipe.",
+		},
+	}
+
+}
+
+// recipePatternRegex is GenericNameRegex also accepting the "::" separator and glob characters of recipe patterns.
+func recipePatternRegex(name string) string {
+	return fmt.Sprintf(`(?P<%s>[\w\-.:*?\[\]]+)`, name)
+}
+
+func recipeFields() map[string]*framework.FieldSchema {
+	fields := mappingTokenFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The recipe glob pattern, e.g. postgresql::server or postgresql::*.",
+	}
+	addMappingFields(fields, combineAdditive)
+	return fields
+}
+
+func (b *backend) getRecipeEntryFromStorage(ctx context.Context, r *logical.Request, name string) (*ChefRecipe, error) {
+	if name == "" {
+		b.Logger().Warn("empty name passed in getRecipeEntryFromStorage")
+		return nil, fmt.Errorf("recipe's <name> is empty")
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+
+	raw, err := r.Storage.Get(ctx, "recipe/"+strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	recipe := &ChefRecipe{}
+	if err := json.Unmarshal(raw.Value, recipe); err != nil {
+		return nil, err
+	}
+	return recipe, nil
+}
+
+func (b *backend) pathRecipeExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	name := d.Get("name").(string)
+
+	p, err := b.getRecipeEntryFromStorage(ctx, req, name)
+	return p != nil, err
+}
+
+func (b *backend) pathRecipeUpdateOrCreate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	var err error
+	var r *ChefRecipe
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+	if _, err := path.Match(name, ""); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid recipe pattern: %s", err)), nil
+	}
+	if req.Operation == logical.UpdateOperation {
+		r, err = b.getRecipeEntryFromStorage(ctx, req, name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r = &ChefRecipe{
+			Name: name,
+		}
+	}
+
+	if err := parseMappingTokenFields(&r.TokenParams, req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenParams(&r.TokenParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := r.parseMappingFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if r.TokenTTL == 0 && r.TokenPeriod == 0 {
+		return nil, fmt.Errorf("you must provide either token_period or token_ttl")
+	}
+
+	if r.TokenPeriod != 0 {
+		r.TokenMaxTTL = 0
+		r.TokenTTL = 0
+	} else if r.TokenMaxTTL < r.TokenTTL {
+		if r.TokenMaxTTL != 0 {
+			return nil, fmt.Errorf("token_max_ttl should always be left zero or be higher than token_ttl")
+		}
+		r.TokenMaxTTL = r.TokenTTL
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	entry, err := logical.StorageEntryJSON("recipe/"+strings.ToLower(name), r)
+	if err != nil {
+		return nil, err
+	}
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) pathRecipeRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+
+	recipe, err := b.getRecipeEntryFromStorage(ctx, req, name)
+	if err != nil {
+		return nil, err
+	} else if recipe == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name": recipe.Name,
+		},
+	}
+	populateMappingTokenData(&recipe.TokenParams, resp.Data)
+	recipe.populateMappingData(resp.Data, combineAdditive)
+
+	return resp, nil
+}
+
+// matches reports whether the pattern matches one of the node recipes. Recipes without a "::" separator are the
+// default recipe of their cookbook, so "postgresql" is matched by both "postgresql" and "postgresql::default".
+func (r *ChefRecipe) matches(recipes []string) bool {
+	for _, recipe := range recipes {
+		candidates := []string{recipe}
+		if !strings.Contains(recipe, "::") {
+			candidates = append(candidates, recipe+"::default")
+		} else if strings.HasSuffix(recipe, "::default") {
+			candidates = append(candidates, strings.TrimSuffix(recipe, "::default"))
+		}
+		for _, c := range candidates {
+			if ok, _ := path.Match(strings.ToLower(r.Name), strings.ToLower(c)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *backend) getRecipeList(ctx context.Context, req *logical.Request) ([]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return listRecipes(ctx, req)
+}
+
+// listRecipes lists the stored recipes, for callers already holding the backend lock.
+func listRecipes(ctx context.Context, req *logical.Request) ([]string, error) {
+	return req.Storage.List(ctx, "recipe/")
+}
+
+func (b *backend) pathRecipeList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	recipes, err := listRecipes(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(recipes), nil
+}
+
+func (b *backend) pathRecipeDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing recipe name"), nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if err := req.Storage.Delete(ctx, "recipe/"+strings.ToLower(name)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
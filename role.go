@@ -8,11 +8,15 @@ import (
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 // ChefRole represent a chef Role that will be matched against the node-name runlist
 type ChefRole struct {
+	tokenutil.TokenParams
+	mappingParams
+
 	Name          string        `json:"name" structs:"name" mapstructure:"name"`
 	VaultPolicies []string      `json:"policies" structs:"policies" mapstructure:"policies"`
 	TTL           time.Duration `json:"ttl" structs:"ttl" mapstructure:"ttl"`
@@ -20,6 +24,14 @@ type ChefRole struct {
 	Period        time.Duration `json:"period" structs:"period" mapstructure:"period"`
 }
 
+const (
+	roleResolutionFirst           = "first"
+	roleResolutionUnion           = "union"
+	roleResolutionHighestPriority = "highest_priority"
+)
+
+var roleResolutions = []string{roleResolutionFirst, roleResolutionUnion, roleResolutionHighestPriority}
+
 func pathRole(b *backend) []*framework.Path {
 	return []*framework.Path{
 		{
@@ -34,28 +46,7 @@ func pathRole(b *backend) []*framework.Path {
 		},
 		{
 			Pattern: "role/" + framework.GenericNameRegex("name"),
-			Fields: map[string]*framework.FieldSchema{
-				"name": {
-					Type:        framework.TypeNameString,
-					Description: "The name of the chef policy.",
-				},
-				"policies": {
-					Type:        framework.TypeStringSlice,
-					Description: "The list of vault's policy to assign.",
-				},
-				"ttl": {
-					Type:        framework.TypeDurationSecond,
-					Description: "The TTL of the generated tokens",
-				},
-				"max_ttl": {
-					Type:        framework.TypeDurationSecond,
-					Description: "The Max TTL of the generated tokens",
-				},
-				"period": {
-					Type:        framework.TypeDurationSecond,
-					Description: "The Period of the generated tokens",
-				},
-			},
+			Fields:  roleFields(),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.pathRoleRead,
 				logical.CreateOperation: b.pathRoleUpdateOrCreate,
@@ -70,6 +61,16 @@ func pathRole(b *backend) []*framework.Path {
 
 }
 
+func roleFields() map[string]*framework.FieldSchema {
+	fields := mappingTokenFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeNameString,
+		Description: "The name of the chef role.",
+	}
+	addMappingFields(fields, combineExclusive)
+	return fields
+}
+
 func (b *backend) getRoleEntryFromStorage(ctx context.Context, r *logical.Request, name string) (*ChefRole, error) {
 	if name == "" {
 		b.Logger().Warn("empty name passed in getRoleEntryFromStorage")
@@ -90,6 +91,7 @@ func (b *backend) getRoleEntryFromStorage(ctx context.Context, r *logical.Reques
 	if err := json.Unmarshal(raw.Value, role); err != nil {
 		return nil, err
 	}
+	upgradeTokenParams(&role.TokenParams, role.VaultPolicies, role.TTL, role.MaxTTL, role.Period)
 	return role, nil
 }
 
@@ -114,44 +116,40 @@ func (b *backend) pathRoleUpdateOrCreate(ctx context.Context, req *logical.Reque
 		}
 	} else {
 		r = &ChefRole{
-			Name:          name,
-			VaultPolicies: []string{},
-			TTL:           0,
-			MaxTTL:        0,
-			Period:        0,
+			Name: name,
 		}
 	}
 
-	if policiesRaw, ok := d.GetOk("policies"); ok {
-		r.VaultPolicies = policiesRaw.([]string)
-	}
-
-	if TTLRaw, ok := d.GetOk("ttl"); ok {
-		r.TTL = time.Duration(TTLRaw.(int)) * time.Second
+	if err := parseMappingTokenFields(&r.TokenParams, req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
-
-	if maxTTLRaw, ok := d.GetOk("max_ttl"); ok {
-		r.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+	if err := validateTokenParams(&r.TokenParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
-
-	if periodRaw, ok := d.GetOk("period"); ok {
-		r.Period = time.Duration(periodRaw.(int)) * time.Second
+	if err := r.parseMappingFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	if r.TTL == 0 && r.Period == 0 {
-		return nil, fmt.Errorf("you must provide either period or ttl")
+	if r.TokenTTL == 0 && r.TokenPeriod == 0 {
+		return nil, fmt.Errorf("you must provide either token_period or token_ttl")
 	}
 
-	if r.Period != 0 {
-		r.MaxTTL = 0
-		r.TTL = 0
-	} else if r.MaxTTL < r.TTL {
-		if r.MaxTTL != 0 {
-			return nil, fmt.Errorf("max_ttl should always be left zero or be higher than ttl")
+	if r.TokenPeriod != 0 {
+		r.TokenMaxTTL = 0
+		r.TokenTTL = 0
+	} else if r.TokenMaxTTL < r.TokenTTL {
+		if r.TokenMaxTTL != 0 {
+			return nil, fmt.Errorf("token_max_ttl should always be left zero or be higher than token_ttl")
 		}
-		r.MaxTTL = r.TTL
+		r.TokenMaxTTL = r.TokenTTL
 	}
 
+	// The legacy fields are only kept to read entries stored before the token_* fields
+	r.VaultPolicies = nil
+	r.TTL = 0
+	r.MaxTTL = 0
+	r.Period = 0
+
 	b.Lock()
 	defer b.Unlock()
 
@@ -177,13 +175,11 @@ func (b *backend) pathRoleRead(ctx context.Context, req *logical.Request, d *fra
 
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"policies": role.VaultPolicies,
-			"name":     role.Name,
-			"ttl":      role.TTL.Seconds(),
-			"max_ttl":  role.MaxTTL.Seconds(),
-			"period":   role.Period.Seconds(),
+			"name": role.Name,
 		},
 	}
+	populateMappingTokenData(&role.TokenParams, resp.Data)
+	role.populateMappingData(resp.Data, combineExclusive)
 
 	return resp, nil
 }
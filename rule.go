@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+// ChefRule represent conditions on the node attributes which, when all met, grant the rule token settings
+type ChefRule struct {
+	tokenutil.TokenParams
+	mappingParams
+
+	Name       string           `json:"name" structs:"name" mapstructure:"name"`
+	Conditions []*ruleCondition `json:"conditions" structs:"conditions" mapstructure:"conditions"`
+}
+
+// Rule condition operators
+const (
+	operatorEquals = "equals"
+	operatorIn     = "in"
+	operatorGlob   = "glob"
+	operatorRegex  = "regex"
+	operatorExists = "exists"
+	operatorSemver = "semver"
+)
+
+var ruleOperators = []string{operatorEquals, operatorIn, operatorGlob, operatorRegex, operatorExists, operatorSemver}
+
+// ruleCondition tests the node attribute at Path, a dotted path as understood by lookupAttribute
+type ruleCondition struct {
+	Path     string   `json:"path" structs:"path" mapstructure:"path"`
+	Operator string   `json:"operator" structs:"operator" mapstructure:"operator"`
+	Values   []string `json:"values" structs:"values" mapstructure:"values"`
+
+	// regex and constraint are the compiled values of the regex and semver operators, set by validate
+	regex      *regexp.Regexp
+	constraint version.Constraints
+}
+
+// ruleConditionCache keeps the validated conditions of the stored rules by name, along with the storage entry they
+// were decoded from, so logins do not compile their regex and semver values again.
+type ruleConditionCache struct {
+	sync.Mutex
+	rules map[string]cachedRuleConditions
+}
+
+type cachedRuleConditions struct {
+	raw        []byte
+	conditions []*ruleCondition
+}
+
+// get returns the cached conditions of the rule if they were decoded from the same storage entry.
+func (c *ruleConditionCache) get(name string, raw []byte) ([]*ruleCondition, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cached, ok := c.rules[name]
+	if !ok || !bytes.Equal(cached.raw, raw) {
+		return nil, false
+	}
+	return cached.conditions, true
+}
+
+func (c *ruleConditionCache) set(name string, raw []byte, conditions []*ruleCondition) {
+	c.Lock()
+	defer c.Unlock()
+	if c.rules == nil {
+		c.rules = map[string]cachedRuleConditions{}
+	}
+	c.rules[name] = cachedRuleConditions{raw: raw, conditions: conditions}
+}
+
+func (c *ruleConditionCache) forget(name string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.rules, name)
+}
+
+func pathRule(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "rule/",
+			Fields:  map[string]*framework.FieldSchema{},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathRuleList,
+			},
+			ExistenceCheck:  nil,
+			HelpSynopsis:    "List all rules configured",
+			HelpDescription: "List all rules configured",
+		},
+		{
+			Pattern: "rule/" + framework.GenericNameRegex("name"),
+			Fields:  ruleFields(),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathRuleRead,
+				logical.CreateOperation: b.pathRuleUpdateOrCreate,
+				logical.UpdateOperation: b.pathRuleUpdateOrCreate,
+				logical.DeleteOperation: b.pathRuleDelete,
+			},
+			ExistenceCheck:  b.pathRuleExistenceCheck,
+			HelpSynopsis:    "CRUD operations on a single rule",
+			HelpDescription: "Let you read, update, create or delete a single rule.",
+		},
+	}
+
+}
+
+func ruleFields() map[string]*framework.FieldSchema {
+	fields := mappingTokenFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeNameString,
+		Description: "The name of the rule.",
+	}
+	fields["conditions"] = &framework.FieldSchema{
+		Type: framework.TypeSlice,
+		Description: `The conditions which must all be met by the node, either objects with path, operator and values keys or ` +
+			`"<path> <operator> [value]" strings, the value of the in operator being comma separated. Operators are equals, in, glob, regex, exists and semver.`,
+	}
+	addMappingFields(fields, combineAdditive)
+	return fields
+}
+
+func (b *backend) getRuleEntryFromStorage(ctx context.Context, r *logical.Request, name string) (*ChefRule, error) {
+	if name == "" {
+		b.Logger().Warn("empty name passed in getRuleEntryFromStorage")
+		return nil, fmt.Errorf("rule's <name> is empty")
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+
+	name = strings.ToLower(name)
+	raw, err := r.Storage.Get(ctx, "rule/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	rule := &ChefRule{}
+	if err := json.Unmarshal(raw.Value, rule); err != nil {
+		return nil, err
+	}
+	if conditions, ok := b.ruleConditions.get(name, raw.Value); ok {
+		rule.Conditions = conditions
+		return rule, nil
+	}
+	// Sets the compiled regex and semver conditions
+	for _, c := range rule.Conditions {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("invalid condition in rule %s: %s", name, err)
+		}
+	}
+	b.ruleConditions.set(name, raw.Value, rule.Conditions)
+	return rule, nil
+}
+
+func (b *backend) pathRuleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	name := d.Get("name").(string)
+
+	p, err := b.getRuleEntryFromStorage(ctx, req, name)
+	return p != nil, err
+}
+
+func (b *backend) pathRuleUpdateOrCreate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	var err error
+	var r *ChefRule
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+	if req.Operation == logical.UpdateOperation {
+		r, err = b.getRuleEntryFromStorage(ctx, req, name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r = &ChefRule{
+			Name: name,
+		}
+	}
+
+	if err := parseMappingTokenFields(&r.TokenParams, req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenParams(&r.TokenParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := r.parseMappingFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if conditionsRaw, ok := d.GetOk("conditions"); ok {
+		r.Conditions, err = parseRuleConditions(conditionsRaw.([]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	if len(r.Conditions) == 0 {
+		return logical.ErrorResponse("a rule needs at least one condition"), nil
+	}
+
+	if r.TokenTTL == 0 && r.TokenPeriod == 0 {
+		return nil, fmt.Errorf("you must provide either token_period or token_ttl")
+	}
+
+	if r.TokenPeriod != 0 {
+		r.TokenMaxTTL = 0
+		r.TokenTTL = 0
+	} else if r.TokenMaxTTL < r.TokenTTL {
+		if r.TokenMaxTTL != 0 {
+			return nil, fmt.Errorf("token_max_ttl should always be left zero or be higher than token_ttl")
+		}
+		r.TokenMaxTTL = r.TokenTTL
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	entry, err := logical.StorageEntryJSON("rule/"+strings.ToLower(name), r)
+	if err != nil {
+		return nil, err
+	}
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) pathRuleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+
+	rule, err := b.getRuleEntryFromStorage(ctx, req, name)
+	if err != nil {
+		return nil, err
+	} else if rule == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":       rule.Name,
+			"conditions": rule.Conditions,
+		},
+	}
+	populateMappingTokenData(&rule.TokenParams, resp.Data)
+	rule.populateMappingData(resp.Data, combineAdditive)
+
+	return resp, nil
+}
+
+// parseRuleConditions parses and validates the conditions of a rule.
+func parseRuleConditions(raw []interface{}) ([]*ruleCondition, error) {
+	conditions := make([]*ruleCondition, 0, len(raw))
+	for _, cRaw := range raw {
+		c := &ruleCondition{}
+		switch v := cRaw.(type) {
+		case string:
+			parts := strings.Fields(v)
+			if len(parts) < 2 || len(parts) > 3 {
+				return nil, fmt.Errorf("invalid condition %q, expected \"<path> <operator> [value]\"", v)
+			}
+			c.Path, c.Operator = parts[0], parts[1]
+			if len(parts) == 3 && c.Operator == operatorIn {
+				c.Values = strings.Split(parts[2], ",")
+			} else if len(parts) == 3 {
+				c.Values = []string{parts[2]}
+			}
+		case map[string]interface{}:
+			if err := mapstructure.WeakDecode(v, c); err != nil {
+				return nil, fmt.Errorf("invalid condition: %s", err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid condition of type %T", cRaw)
+		}
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// compileRuleRegex compiles the pattern of a regex condition, anchored as the equals and glob operators match the
+// whole value.
+func compileRuleRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+func (c *ruleCondition) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("condition without path")
+	}
+	if !strutil.StrListContains(ruleOperators, c.Operator) {
+		return fmt.Errorf("invalid operator %q on %s, must be one of %s", c.Operator, c.Path, strings.Join(ruleOperators, ", "))
+	}
+
+	switch c.Operator {
+	case operatorExists:
+		if len(c.Values) != 0 {
+			return fmt.Errorf("operator exists on %s takes no value", c.Path)
+		}
+		return nil
+	case operatorIn:
+		if len(c.Values) == 0 {
+			return fmt.Errorf("operator in on %s needs at least one value", c.Path)
+		}
+		return nil
+	}
+
+	if len(c.Values) != 1 {
+		return fmt.Errorf("operator %s on %s takes exactly one value", c.Operator, c.Path)
+	}
+	var err error
+	switch c.Operator {
+	case operatorGlob:
+		_, err = path.Match(c.Values[0], "")
+	case operatorRegex:
+		c.regex, err = compileRuleRegex(c.Values[0])
+	case operatorSemver:
+		c.constraint, err = version.NewConstraint(c.Values[0])
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s value on %s: %s", c.Operator, c.Path, err)
+	}
+	return nil
+}
+
+// matches reports whether the node attributes meet every condition of the rule.
+func (r *ChefRule) matches(attrs map[string]interface{}) bool {
+	for _, c := range r.Conditions {
+		if !c.matches(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether the node attributes meet the condition. Conditions on list attributes are met
+// when one of the list elements meets them.
+func (c *ruleCondition) matches(attrs map[string]interface{}) bool {
+	v, ok := lookupAttribute(attrs, c.Path)
+	if c.Operator == operatorExists {
+		return ok
+	}
+	if !ok {
+		return false
+	}
+
+	values, isList := v.([]interface{})
+	if !isList {
+		values = []interface{}{v}
+	}
+	for _, value := range values {
+		s, err := attributeString(value)
+		if err != nil {
+			continue
+		}
+		if c.matchesValue(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ruleCondition) matchesValue(s string) bool {
+	switch c.Operator {
+	case operatorEquals:
+		return s == c.Values[0]
+	case operatorIn:
+		return strutil.StrListContains(c.Values, s)
+	case operatorGlob:
+		ok, _ := path.Match(c.Values[0], s)
+		return ok
+	case operatorRegex:
+		return c.regex != nil && c.regex.MatchString(s)
+	case operatorSemver:
+		if c.constraint == nil {
+			return false
+		}
+		v, err := version.NewVersion(s)
+		if err != nil {
+			return false
+		}
+		return c.constraint.Check(v)
+	}
+	return false
+}
+
+func (b *backend) getRuleList(ctx context.Context, req *logical.Request) ([]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return req.Storage.List(ctx, "rule/")
+}
+
+func (b *backend) pathRuleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	rules, err := req.Storage.List(ctx, "rule/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(rules), nil
+}
+
+func (b *backend) pathRuleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing rule name"), nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if err := req.Storage.Delete(ctx, "rule/"+strings.ToLower(name)); err != nil {
+		return nil, err
+	}
+	b.ruleConditions.forget(strings.ToLower(name))
+	return nil, nil
+}
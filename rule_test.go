@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRuleConditionsCompiledOnce(t *testing.T) {
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+	testWrite(t, b, storage, "rule/web", map[string]interface{}{
+		"conditions":     []interface{}{"name regex web-.*", "platform_version semver >=10"},
+		"token_policies": "web",
+		"token_ttl":      3600,
+	})
+
+	first, err := b.getRuleEntryFromStorage(context.Background(), req, "web")
+	if err != nil || first == nil {
+		t.Fatalf("reading the rule: %v %v", first, err)
+	}
+	if first.Conditions[0].regex == nil || first.Conditions[1].constraint == nil {
+		t.Fatal("the conditions were not compiled")
+	}
+	second, err := b.getRuleEntryFromStorage(context.Background(), req, "web")
+	if err != nil || second == nil {
+		t.Fatalf("reading the rule: %v %v", second, err)
+	}
+	if second.Conditions[0] != first.Conditions[0] {
+		t.Error("the conditions were compiled again")
+	}
+	if !second.matches(map[string]interface{}{"name": "web-1", "platform_version": "10.4"}) {
+		t.Error("expected the rule to match")
+	}
+
+	// A changed rule is compiled again
+	testWrite(t, b, storage, "rule/web", map[string]interface{}{"conditions": []interface{}{"name regex db-.*"}})
+	changed, err := b.getRuleEntryFromStorage(context.Background(), req, "web")
+	if err != nil || changed == nil {
+		t.Fatalf("reading the rule: %v %v", changed, err)
+	}
+	if !changed.matches(map[string]interface{}{"name": "db-1"}) {
+		t.Error("expected the changed rule to match")
+	}
+
+	// Deleted rules are not kept
+	if _, err := testRequest(t, b, storage, logical.DeleteOperation, "rule/web", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.ruleConditions.rules) != 0 {
+		t.Errorf("the conditions of the deleted rule were kept: %v", b.ruleConditions.rules)
+	}
+}
+
+func TestRuleInvalidSemverConstraint(t *testing.T) {
+	b, storage := testBackend(t)
+	resp, err := testRequest(t, b, storage, logical.CreateOperation, "rule/web", map[string]interface{}{
+		"conditions":     []interface{}{"platform_version semver not-a-version"},
+		"token_policies": "web",
+		"token_ttl":      3600,
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected the rule to be rejected, got %v %v", resp, err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// searchFetcher returns the names of the nodes matching a search, along with the time they were fetched from the
+// Chef server
+type searchFetcher func(ctx context.Context) (map[string]bool, time.Time, error)
+
+// searchCacheEntry holds the nodes matching a search when it was fetched
+type searchCacheEntry struct {
+	nodes      map[string]bool
+	fetchedAt  time.Time
+	ttl        time.Duration
+	refreshing bool
+}
+
+// searchCacheStats counts the cache lookups since the backend started
+type searchCacheStats struct {
+	Hits          uint64
+	StaleHits     uint64
+	Misses        uint64
+	Refreshes     uint64
+	RefreshErrors uint64
+	// SharedFetches counts the fetches answered by a concurrent fetch of the same search
+	SharedFetches uint64
+}
+
+// searchCache caches the result of remote searches for their AllowedStaleness, keyed by lowercase search name. Entries
+// older than half their TTL are still served, while being refreshed in the background, but never past their TTL.
+type searchCache struct {
+	sync.Mutex
+	entries map[string]*searchCacheEntry
+	stats   searchCacheStats
+	flight  flightGroup
+	// generations counts the invalidations of each search and purges the purges of the whole cache, so the fetches
+	// started before them do not store their outdated result
+	generations map[string]uint64
+	purges      uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// logError reports the errors of background refreshes
+	logError func(msg string, args ...interface{})
+}
+
+func newSearchCache(logError func(msg string, args ...interface{})) *searchCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &searchCache{
+		entries:     map[string]*searchCacheEntry{},
+		generations: map[string]uint64{},
+		ctx:         ctx,
+		cancel:      cancel,
+		logError:    logError,
+	}
+}
+
+// get returns the nodes matching the search name, fetching them with the Chef client identified by client when they
+// are not cached or expired. It waits for the fetch until ctx is done.
+func (c *searchCache) get(ctx context.Context, name, client string, ttl time.Duration, fetch searchFetcher) (map[string]bool, error) {
+	if ttl == 0 {
+		nodes, _, err := c.fetch(ctx, name, client, fetch)
+		return nodes, err
+	}
+
+	c.Lock()
+	generation := c.generation(name)
+	e, ok := c.entries[name]
+	if ok {
+		age := time.Since(e.fetchedAt)
+		switch {
+		case age < e.ttl/2:
+			c.stats.Hits++
+			c.Unlock()
+			return e.nodes, nil
+		case age < e.ttl:
+			c.stats.StaleHits++
+			if !e.refreshing && c.ctx.Err() == nil {
+				e.refreshing = true
+				c.wg.Add(1)
+				go c.refresh(name, client, generation, ttl, fetch)
+			}
+			c.Unlock()
+			return e.nodes, nil
+		}
+	}
+	c.stats.Misses++
+	c.Unlock()
+
+	nodes, fetchedAt, err := c.fetch(ctx, name, client, fetch)
+	if err != nil {
+		return nil, err
+	}
+	c.store(name, generation, ttl, nodes, fetchedAt)
+	return nodes, nil
+}
+
+func (c *searchCache) refresh(name, client string, generation uint64, ttl time.Duration, fetch searchFetcher) {
+	defer c.wg.Done()
+
+	nodes, fetchedAt, err := c.fetch(c.ctx, name, client, fetch)
+
+	c.Lock()
+	c.stats.Refreshes++
+	if e, ok := c.entries[name]; ok {
+		e.refreshing = false
+	}
+	if err != nil {
+		c.stats.RefreshErrors++
+		c.logError("error while refreshing the search cache", "search", name, "error", err)
+	}
+	c.Unlock()
+	if err != nil {
+		return
+	}
+	c.store(name, generation, ttl, nodes, fetchedAt)
+}
+
+// last returns the cached result of a search, whatever its age.
+func (c *searchCache) last(name string) (map[string]bool, time.Time, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return e.nodes, e.fetchedAt, true
+}
+
+// expiresWithin reports whether the search is not cached or its result expires within d.
+func (c *searchCache) expiresWithin(name string, d time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[name]
+	return !ok || time.Since(e.fetchedAt)+d >= e.ttl
+}
+
+// prefetch fetches and caches a search ahead of its expiry, unless it is already being refreshed.
+func (c *searchCache) prefetch(name, client string, ttl time.Duration, fetch searchFetcher) error {
+	c.Lock()
+	if c.ctx.Err() != nil {
+		c.Unlock()
+		return c.ctx.Err()
+	}
+	generation := c.generation(name)
+	e, ok := c.entries[name]
+	if ok && e.refreshing {
+		c.Unlock()
+		return nil
+	}
+	if ok {
+		e.refreshing = true
+	}
+	c.wg.Add(1)
+	c.Unlock()
+	defer c.wg.Done()
+
+	nodes, fetchedAt, err := c.fetch(c.ctx, name, client, fetch)
+
+	c.Lock()
+	c.stats.Refreshes++
+	if e, ok := c.entries[name]; ok {
+		e.refreshing = false
+	}
+	if err != nil {
+		c.stats.RefreshErrors++
+	}
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+	c.store(name, generation, ttl, nodes, fetchedAt)
+	return nil
+}
+
+// fetch runs a search, sharing the result of a fetch of the same search by the same client already in flight, so a
+// burst of logins on an expired search only sends one request to the Chef server. It waits for the result until ctx
+// is done.
+func (c *searchCache) fetch(ctx context.Context, name, client string, fetch searchFetcher) (map[string]bool, time.Time, error) {
+	nodes, fetchedAt, shared, err := c.flight.do(ctx, c.ctx, flightKey{name: name, client: client}, fetch)
+	if shared {
+		c.Lock()
+		c.stats.SharedFetches++
+		c.Unlock()
+	}
+	return nodes, fetchedAt, err
+}
+
+// generation identifies the state of a search in the cache, it changes whenever the search is invalidated or the cache
+// purged. The counters only grow, so their sum never comes back to a previous value. c must be locked.
+func (c *searchCache) generation(name string) uint64 {
+	return c.purges + c.generations[name]
+}
+
+// store caches the result of a fetch started at the given generation, unless the search was invalidated since.
+func (c *searchCache) store(name string, generation uint64, ttl time.Duration, nodes map[string]bool, fetchedAt time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if c.ctx.Err() != nil || c.generation(name) != generation {
+		return
+	}
+	c.entries[name] = &searchCacheEntry{nodes: nodes, fetchedAt: fetchedAt, ttl: ttl}
+}
+
+// invalidate removes the cached result of a search.
+func (c *searchCache) invalidate(name string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, name)
+	c.generations[name]++
+	c.flight.forget(name)
+}
+
+// purge removes every cached result.
+func (c *searchCache) purge() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = map[string]*searchCacheEntry{}
+	c.purges++
+	c.flight.forgetAll()
+}
+
+// stop cancels the background refreshes and the fetches in flight and waits for them to return, the cache is no
+// longer filled afterwards.
+func (c *searchCache) stop() {
+	c.cancel()
+	c.flight.stop()
+	c.wg.Wait()
+	c.purge()
+}
+
+func pathSearchCache(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "search-cache",
+		Fields:  map[string]*framework.FieldSchema{},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathSearchCacheRead,
+		},
+		HelpSynopsis:    "Statistics of the search cache.",
+		HelpDescription: "Statistics of the search cache, along with the age of the cached searches.",
+	}
+}
+
+func (b *backend) pathSearchCacheRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	c := b.searchCache
+	c.Lock()
+	defer c.Unlock()
+
+	entries := make(map[string]interface{}, len(c.entries))
+	for name, e := range c.entries {
+		entries[name] = map[string]interface{}{
+			"fetched_at": e.fetchedAt.Format(time.RFC3339),
+			"age":        int64(time.Since(e.fetchedAt).Seconds()),
+			"ttl":        int64(e.ttl.Seconds()),
+			"nodes":      len(e.nodes),
+			"refreshing": e.refreshing,
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"hits":           c.stats.Hits,
+			"stale_hits":     c.stats.StaleHits,
+			"misses":         c.stats.Misses,
+			"refreshes":      c.stats.Refreshes,
+			"refresh_errors": c.stats.RefreshErrors,
+			"shared_fetches": c.stats.SharedFetches,
+			"entries":        entries,
+		},
+	}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSearchCache(t testing.TB) *searchCache {
+	c := newSearchCache(func(msg string, args ...interface{}) { t.Log(append([]interface{}{msg}, args...)...) })
+	t.Cleanup(c.stop)
+	return c
+}
+
+// fetchedAgo returns a fetcher of nodes, counting its calls, whose results are age old
+func fetchedAgo(age time.Duration, calls *int64, nodes ...string) searchFetcher {
+	return func(ctx context.Context) (map[string]bool, time.Time, error) {
+		atomic.AddInt64(calls, 1)
+		set := map[string]bool{}
+		for _, n := range nodes {
+			set[n] = true
+		}
+		return set, time.Now().Add(-age), nil
+	}
+}
+
+func TestSearchCacheStaleness(t *testing.T) {
+	const ttl = time.Hour
+
+	tests := []struct {
+		name    string
+		age     time.Duration
+		stats   searchCacheStats
+		fetches int64
+	}{
+		{"fresh", ttl / 4, searchCacheStats{Hits: 1}, 0},
+		{"stale", 3 * ttl / 4, searchCacheStats{StaleHits: 1, Refreshes: 1}, 1},
+		{"expired", ttl + time.Minute, searchCacheStats{Misses: 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testSearchCache(t)
+			c.store("web", c.generation("web"), ttl, map[string]bool{"old": true}, time.Now().Add(-tt.age))
+
+			var fetches int64
+			nodes, err := c.get(context.Background(), "web", "vault", ttl, fetchedAgo(0, &fetches, "new"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.wg.Wait()
+
+			// Results are only served until their TTL, stale ones being refreshed in the background
+			expected := map[string]bool{"old": true}
+			if tt.age >= ttl {
+				expected = map[string]bool{"new": true}
+			}
+			if !reflect.DeepEqual(nodes, expected) {
+				t.Errorf("got %v, expected %v", nodes, expected)
+			}
+			if fetches != tt.fetches {
+				t.Errorf("%d fetches, expected %d", fetches, tt.fetches)
+			}
+			if c.stats != tt.stats {
+				t.Errorf("stats %+v, expected %+v", c.stats, tt.stats)
+			}
+			if cached, _, _ := c.last("web"); tt.fetches > 0 && !cached["new"] {
+				t.Errorf("the fetched result was not cached: %v", cached)
+			}
+		})
+	}
+}
+
+func TestSearchCacheInvalidatedWhileFetching(t *testing.T) {
+	for name, invalidate := range map[string]func(c *searchCache){
+		"invalidate": func(c *searchCache) { c.invalidate("web") },
+		"purge":      func(c *searchCache) { c.purge() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := testSearchCache(t)
+			started := make(chan struct{})
+			release := make(chan struct{})
+			fetch := func(ctx context.Context) (map[string]bool, time.Time, error) {
+				close(started)
+				<-release
+				return map[string]bool{"outdated": true}, time.Now(), nil
+			}
+
+			done := make(chan error)
+			go func() {
+				_, err := c.get(context.Background(), "web", "vault", time.Hour, fetch)
+				done <- err
+			}()
+			<-started
+			invalidate(c)
+			close(release)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			if nodes, _, ok := c.last("web"); ok {
+				t.Errorf("the result fetched before the invalidation was cached: %v", nodes)
+			}
+		})
+	}
+}
+
+func TestSearchCachePrefetchInvalidatedWhileFetching(t *testing.T) {
+	c := testSearchCache(t)
+	fetch := func(ctx context.Context) (map[string]bool, time.Time, error) {
+		c.invalidate("web")
+		return map[string]bool{"outdated": true}, time.Now(), nil
+	}
+	if err := c.prefetch("web", "vault", time.Hour, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, _, ok := c.last("web"); ok {
+		t.Errorf("the result fetched before the invalidation was cached: %v", nodes)
+	}
+}
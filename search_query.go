@@ -0,0 +1,486 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-chef/chef"
+)
+
+// errUnsupportedQuery is returned for queries using Solr syntax the local matcher does not implement,
+// they are left to the Chef server
+var errUnsupportedQuery = errors.New("unsupported search query syntax")
+
+// searchQuery is a parsed Chef search query, evaluated against the indexed fields of a single node
+type searchQuery interface {
+	matches(fields map[string][]string) bool
+}
+
+type allQuery struct{}
+
+func (allQuery) matches(map[string][]string) bool { return true }
+
+type termQuery struct {
+	field string
+	value *regexp.Regexp
+}
+
+func (q *termQuery) matches(fields map[string][]string) bool {
+	for _, v := range fields[q.field] {
+		if q.value.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type rangeQuery struct {
+	field                      string
+	lower, upper               string
+	includeLower, includeUpper bool
+}
+
+func (q *rangeQuery) matches(fields map[string][]string) bool {
+	for _, v := range fields[q.field] {
+		if q.lower != "*" {
+			c := compareIndexed(v, q.lower)
+			if c < 0 || (c == 0 && !q.includeLower) {
+				continue
+			}
+		}
+		if q.upper != "*" {
+			c := compareIndexed(v, q.upper)
+			if c > 0 || (c == 0 && !q.includeUpper) {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compareIndexed compares two indexed values, numerically when both are numbers.
+func compareIndexed(a, b string) int {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+type andQuery []searchQuery
+
+func (q andQuery) matches(fields map[string][]string) bool {
+	for _, sub := range q {
+		if !sub.matches(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+type orQuery []searchQuery
+
+func (q orQuery) matches(fields map[string][]string) bool {
+	for _, sub := range q {
+		if sub.matches(fields) {
+			return true
+		}
+	}
+	return false
+}
+
+type notQuery struct {
+	query searchQuery
+}
+
+func (q *notQuery) matches(fields map[string][]string) bool {
+	return !q.query.matches(fields)
+}
+
+// parseSearchQuery parses the subset of the Solr syntax used in Chef searches: field:value clauses with
+// * and ? wildcards, quoted values, [a TO b] and {a TO b} ranges, AND, OR, NOT, &&, ||, !, + and - operators
+// and parentheses. Clauses are joined with AND by default, like the Chef server does.
+// It returns errUnsupportedQuery for any other syntax.
+func parseSearchQuery(query string) (searchQuery, error) {
+	tokens, err := tokenizeSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errUnsupportedQuery
+	}
+	p := &queryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errUnsupportedQuery
+	}
+	return q, nil
+}
+
+type queryTokenKind int
+
+const (
+	tokenClause queryTokenKind = iota
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenRequired
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind   queryTokenKind
+	clause searchQuery
+}
+
+func tokenizeSearchQuery(query string) ([]queryToken, error) {
+	runes := []rune(query)
+	tokens := []queryToken{}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose})
+			i++
+		case r == '!' || r == '-':
+			tokens = append(tokens, queryToken{kind: tokenNot})
+			i++
+		case r == '+':
+			tokens = append(tokens, queryToken{kind: tokenRequired})
+			i++
+		case strings.HasPrefix(string(runes[i:]), "&&"):
+			tokens = append(tokens, queryToken{kind: tokenAnd})
+			i += 2
+		case strings.HasPrefix(string(runes[i:]), "||"):
+			tokens = append(tokens, queryToken{kind: tokenOr})
+			i += 2
+		default:
+			token, n, err := readClause(runes[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+			i += n
+		}
+	}
+	return tokens, nil
+}
+
+// readClause reads an operator word or a field:value clause, returning the number of runes consumed.
+func readClause(runes []rune) (queryToken, int, error) {
+	i := 0
+	field := []rune{}
+	for ; i < len(runes) && runes[i] != ':'; i++ {
+		r := runes[i]
+		if r == '\\' && i+1 < len(runes) {
+			i++
+			field = append(field, runes[i])
+			continue
+		}
+		if unicode.IsSpace(r) || r == '(' || r == ')' {
+			break
+		}
+		field = append(field, r)
+	}
+
+	if i == len(runes) || runes[i] != ':' {
+		switch string(field) {
+		case "AND":
+			return queryToken{kind: tokenAnd}, i, nil
+		case "OR":
+			return queryToken{kind: tokenOr}, i, nil
+		case "NOT":
+			return queryToken{kind: tokenNot}, i, nil
+		}
+		// Searching the default field is not supported
+		return queryToken{}, 0, errUnsupportedQuery
+	}
+	if len(field) == 0 || (strings.ContainsAny(string(field), "*?") && string(field) != "*") {
+		return queryToken{}, 0, errUnsupportedQuery
+	}
+	i++
+
+	if i == len(runes) {
+		return queryToken{}, 0, errUnsupportedQuery
+	}
+	switch runes[i] {
+	case '[', '{':
+		end := i + 1
+		for end < len(runes) && runes[end] != ']' && runes[end] != '}' {
+			end++
+		}
+		if end == len(runes) {
+			return queryToken{}, 0, errUnsupportedQuery
+		}
+		bounds := strings.Fields(string(runes[i+1 : end]))
+		if len(bounds) != 3 || bounds[1] != "TO" {
+			return queryToken{}, 0, errUnsupportedQuery
+		}
+		q := &rangeQuery{
+			field:        string(field),
+			lower:        bounds[0],
+			upper:        bounds[2],
+			includeLower: runes[i] == '[',
+			includeUpper: runes[end] == ']',
+		}
+		return queryToken{kind: tokenClause, clause: q}, end + 1, nil
+	case '"':
+		end := i + 1
+		value := []rune{}
+		for ; end < len(runes) && runes[end] != '"'; end++ {
+			if runes[end] == '\\' && end+1 < len(runes) {
+				end++
+			}
+			value = append(value, runes[end])
+		}
+		if end == len(runes) {
+			return queryToken{}, 0, errUnsupportedQuery
+		}
+		q, err := newTermQuery(string(field), regexp.QuoteMeta(string(value)))
+		if err != nil {
+			return queryToken{}, 0, err
+		}
+		return queryToken{kind: tokenClause, clause: q}, end + 1, nil
+	case '(', '/':
+		// Field grouping and regular expressions are left to the Chef server
+		return queryToken{}, 0, errUnsupportedQuery
+	}
+
+	pattern := strings.Builder{}
+	for ; i < len(runes); i++ {
+		r := runes[i]
+		if r == '\\' && i+1 < len(runes) {
+			i++
+			pattern.WriteString(regexp.QuoteMeta(string(runes[i])))
+			continue
+		}
+		if unicode.IsSpace(r) || r == ')' {
+			break
+		}
+		switch r {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		case '~', '^', '(', '[', '{', '"', ':':
+			// Fuzzy searches, boosts and other constructs are left to the Chef server
+			return queryToken{}, 0, errUnsupportedQuery
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	if string(field) == "*" {
+		if pattern.String() != ".*" {
+			return queryToken{}, 0, errUnsupportedQuery
+		}
+		return queryToken{kind: tokenClause, clause: allQuery{}}, i, nil
+	}
+	q, err := newTermQuery(string(field), pattern.String())
+	if err != nil {
+		return queryToken{}, 0, err
+	}
+	return queryToken{kind: tokenClause, clause: q}, i, nil
+}
+
+func newTermQuery(field, pattern string) (*termQuery, error) {
+	// Chef indexes values case-insensitively
+	value, err := regexp.Compile("(?is)^" + pattern + "$")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", errUnsupportedQuery, err)
+	}
+	return &termQuery{field: field, value: value}, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) parseOr() (searchQuery, error) {
+	q, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := orQuery{q}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != tokenOr {
+			break
+		}
+		p.pos++
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, q)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *queryParser) parseAnd() (searchQuery, error) {
+	q, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	and := andQuery{q}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == tokenOr || t.kind == tokenClose {
+			break
+		}
+		if t.kind == tokenAnd {
+			p.pos++
+		}
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, q)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *queryParser) parseUnary() (searchQuery, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errUnsupportedQuery
+	}
+	p.pos++
+	switch t.kind {
+	case tokenNot:
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notQuery{query: q}, nil
+	case tokenRequired:
+		return p.parseUnary()
+	case tokenOpen:
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != tokenClose {
+			return nil, errUnsupportedQuery
+		}
+		p.pos++
+		return q, nil
+	case tokenClause:
+		return t.clause, nil
+	}
+	return nil, errUnsupportedQuery
+}
+
+// indexedFields returns the fields the Chef server indexes for a node: its name, environment, policy, run list
+// and attributes, merged following Chef's precedence. Nested attributes are indexed under both their full path
+// joined by underscores and their last key, like the Chef server does.
+func indexedFields(node *chef.Node) map[string][]string {
+	fields := map[string][]string{
+		"name":             {node.Name},
+		"chef_type":        {"node"},
+		"chef_environment": {node.Environment},
+	}
+	if node.PolicyName != "" {
+		fields["policy_name"] = []string{node.PolicyName}
+	}
+	if node.PolicyGroup != "" {
+		fields["policy_group"] = []string{node.PolicyGroup}
+	}
+	for _, item := range node.RunList {
+		fields["run_list"] = append(fields["run_list"], item)
+		if strings.HasPrefix(item, "recipe[") && strings.HasSuffix(item, "]") {
+			fields["recipe"] = append(fields["recipe"], item[len("recipe["):len(item)-1])
+		} else if strings.HasPrefix(item, "role[") && strings.HasSuffix(item, "]") {
+			fields["role"] = append(fields["role"], item[len("role["):len(item)-1])
+		}
+	}
+
+	attrs := nodeAttributes(node)
+	merged := map[string]interface{}{}
+	for i := len(attributePrecedence) - 1; i >= 0; i-- {
+		level, _ := attrs[attributePrecedence[i]].(map[string]interface{})
+		deepMerge(merged, level)
+	}
+	flattenAttributes(fields, nil, merged)
+	return fields
+}
+
+// deepMerge merges src into dst, src values winning.
+func deepMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, srcOk := v.(map[string]interface{})
+		dstMap, dstOk := dst[k].(map[string]interface{})
+		if srcOk && dstOk {
+			deepMerge(dstMap, srcMap)
+			continue
+		}
+		if srcOk {
+			copied := map[string]interface{}{}
+			deepMerge(copied, srcMap)
+			v = copied
+		}
+		dst[k] = v
+	}
+}
+
+func flattenAttributes(fields map[string][]string, path []string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			flattenAttributes(fields, append(path[:len(path):len(path)], k), sub)
+		}
+	case []interface{}:
+		for _, sub := range v {
+			flattenAttributes(fields, path, sub)
+		}
+	case nil:
+	default:
+		if len(path) == 0 {
+			return
+		}
+		s, err := attributeString(v)
+		if err != nil {
+			return
+		}
+		full := strings.Join(path, "_")
+		fields[full] = append(fields[full], s)
+		if leaf := path[len(path)-1]; leaf != full {
+			fields[leaf] = append(fields[leaf], s)
+		}
+	}
+}
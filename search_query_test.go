@@ -0,0 +1,191 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chef/chef"
+)
+
+func testNode() *chef.Node {
+	return &chef.Node{
+		Name:        "web1.example.com",
+		Environment: "production",
+		PolicyName:  "webserver",
+		PolicyGroup: "prod",
+		RunList:     []string{"recipe[nginx::default]", "role[web]"},
+		AutomaticAttributes: map[string]interface{}{
+			"platform":         "ubuntu",
+			"platform_version": "20.04",
+			"cloud":            map[string]interface{}{"provider": "aws"},
+			"memory":           map[string]interface{}{"total_kb": float64(2048000)},
+		},
+		NormalAttributes: map[string]interface{}{
+			"tags": []interface{}{"pci", "frontend"},
+		},
+		DefaultAttributes: map[string]interface{}{
+			"cloud": map[string]interface{}{"provider": "gce", "region": "eu-west-1"},
+			"app":   map[string]interface{}{"name": "billing api"},
+		},
+		OverrideAttributes: map[string]interface{}{
+			"app": map[string]interface{}{"port": float64(8080)},
+		},
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	fields := indexedFields(testNode())
+
+	tests := []struct {
+		query   string
+		matches bool
+	}{
+		// Terms
+		{"name:web1.example.com", true},
+		{"name:web2.example.com", false},
+		{"NAME:web1.example.com", false},
+		{"name:WEB1.EXAMPLE.COM", true},
+		{"chef_environment:production", true},
+		{"policy_group:prod", true},
+		{"*:*", true},
+
+		// Wildcards
+		{"name:web*", true},
+		{"name:db*", false},
+		{"name:web?.example.com", true},
+		{"name:web??.example.com", false},
+		{"recipe:nginx*", true},
+		{"platform_version:20.*", true},
+
+		// Quoted and escaped values
+		{`app_name:"billing api"`, true},
+		{`app_name:"billing"`, false},
+		{`app_name:"billing*"`, false},
+		{`name:web1.example.com\*`, false},
+		{`app_name:billing\ api`, true},
+
+		// Ranges
+		{"memory_total_kb:[1000000 TO 4000000]", true},
+		{"memory_total_kb:[1000000 TO 2048000]", true},
+		{"memory_total_kb:[1000000 TO 2048000}", false},
+		{"memory_total_kb:{2048000 TO *]", false},
+		{"memory_total_kb:[* TO 100000]", false},
+		{"platform:[a TO v]", true},
+		{"platform:[a TO c]", false},
+
+		// Operators
+		{"role:web AND chef_environment:production", true},
+		{"role:web AND chef_environment:staging", false},
+		{"role:web && chef_environment:production", true},
+		{"role:web chef_environment:production", true},
+		{"role:web chef_environment:staging", false},
+		{"role:db OR chef_environment:production", true},
+		{"role:db || chef_environment:staging", false},
+		{"NOT role:db", true},
+		{"NOT role:web", false},
+		{"!role:web", false},
+		{"-role:web", false},
+		{"+role:web", true},
+		{"role:web -chef_environment:staging", true},
+		{"role:web AND NOT tags:pci", false},
+		{"(role:db OR role:web) AND (tags:pci OR tags:sox)", true},
+		{"(role:db OR role:cache) AND tags:pci", false},
+		{"role:db OR role:web AND tags:sox", false},
+		{"role:web OR role:db AND tags:sox", true},
+
+		// Attributes
+		{"cloud_provider:aws", true},
+		{"provider:aws", true},
+		{"cloud_provider:gce", false},
+		{"cloud_region:eu-west-1", true},
+		{"region:eu*", true},
+		{"app_port:8080", true},
+		{"tags:frontend", true},
+		{"tags:backend", false},
+		{"run_list:role\\[web\\]", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseSearchQuery(tt.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := q.matches(fields); got != tt.matches {
+				t.Errorf("matches %v, expected %v", got, tt.matches)
+			}
+		})
+	}
+}
+
+func TestParseSearchQueryUnsupported(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"web1",
+		"name:",
+		"na*e:web1",
+		"name:web1~",
+		"name:web1~0.8",
+		"name:web1^2",
+		"name:/web[0-9]/",
+		"name:(web1 OR web2)",
+		`name:"web1`,
+		"memory_total_kb:[1000 2000]",
+		"memory_total_kb:[1000 TO 2000",
+		"*:web1",
+		"(role:web",
+		"role:web)",
+		"role:web AND",
+		"NOT",
+	} {
+		t.Run(query, func(t *testing.T) {
+			_, err := parseSearchQuery(query)
+			// Invalid patterns are reported with the errUnsupportedQuery message
+			if err == nil || !strings.HasPrefix(err.Error(), errUnsupportedQuery.Error()) {
+				t.Errorf("expected errUnsupportedQuery, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIndexedFields(t *testing.T) {
+	fields := indexedFields(testNode())
+
+	expected := map[string][]string{
+		"chef_type":        {"node"},
+		"chef_environment": {"production"},
+		"policy_name":      {"webserver"},
+		"policy_group":     {"prod"},
+		"run_list":         {"recipe[nginx::default]", "role[web]"},
+		"recipe":           {"nginx::default"},
+		"role":             {"web"},
+		"platform":         {"ubuntu"},
+		"platform_version": {"20.04"},
+		// Automatic attributes win over default ones
+		"cloud_provider":  {"aws"},
+		"provider":        {"aws"},
+		"cloud_region":    {"eu-west-1"},
+		"region":          {"eu-west-1"},
+		"memory_total_kb": {"2048000"},
+		"total_kb":        {"2048000"},
+		"tags":            {"frontend", "pci"},
+		"app_name":        {"billing api"},
+		"app_port":        {"8080"},
+		"port":            {"8080"},
+	}
+	for _, values := range fields {
+		sort.Strings(values)
+	}
+	for field, values := range expected {
+		sort.Strings(values)
+		if !reflect.DeepEqual(fields[field], values) {
+			t.Errorf("field %s: got %v, expected %v", field, fields[field], values)
+		}
+	}
+	// The leaf key of app_name is name, indexed along the node name
+	if !reflect.DeepEqual(fields["name"], []string{"billing api", "web1.example.com"}) {
+		t.Errorf("field name: got %v", fields["name"])
+	}
+}
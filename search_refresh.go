@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// searchRefreshWindow is how long before their expiry cached searches are refreshed, it covers the interval
+	// between two runs of the periodic function
+	searchRefreshWindow = 2 * time.Minute
+	// searchRefreshLeadFraction bounds the refresh window to a quarter of the allowed staleness, so searches with a
+	// small staleness are not refreshed on every run
+	searchRefreshLeadFraction = 4
+	// searchRefreshConcurrency is the maximum number of searches refreshed at the same time
+	searchRefreshConcurrency = 4
+	// searchRefreshMaxJitter bounds the random delay spreading the refreshes
+	searchRefreshMaxJitter = 10 * time.Second
+)
+
+// refreshSearches refreshes the cached searches about to expire with the configured client, so logins read a warm
+// cache instead of waiting for the Chef server. Searches are only refreshed when client_name and client_key are set.
+func (b *backend) refreshSearches(ctx context.Context, req *logical.Request) error {
+	b.RLock()
+	conf, err := b.getConfigFromStorage(ctx, req)
+	b.RUnlock()
+	if err != nil {
+		return err
+	}
+	if conf == nil || !conf.hasClient() {
+		return nil
+	}
+
+	searches, err := b.getSearchEntriesFromStorage(ctx, req)
+	if err != nil {
+		return err
+	}
+	client, err := newAdminChefClient(conf)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, searchRefreshConcurrency)
+	wg := sync.WaitGroup{}
+	for _, s := range searches {
+		if !s.usesCache() {
+			continue
+		}
+		name := strings.ToLower(s.Name)
+		lead := searchRefreshLead(s)
+		if !b.searchCache.expiresWithin(name, lead) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *ChefSearch) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			jitter := searchRefreshMaxJitter
+			if s.AllowedStaleness/10 < jitter {
+				jitter = s.AllowedStaleness / 10
+			}
+			if jitter > 0 {
+				select {
+				case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			// A result stored by another Vault node is reused as long as it does not expire before the next run
+			err := b.searchCache.prefetch(name, client.identity(), s.AllowedStaleness, func(ctx context.Context) (map[string]bool, time.Time, error) {
+				return b.loadOrFetchSearch(ctx, req.Storage, client, s, s.AllowedStaleness-lead)
+			})
+			if err != nil {
+				b.Logger().Error("error while refreshing the search cache", "search", s.Name, "error", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	return nil
+}
+
+// searchRefreshLead returns how long before its expiry the search is refreshed.
+func searchRefreshLead(s *ChefSearch) time.Duration {
+	if s.AllowedStaleness/searchRefreshLeadFraction < searchRefreshWindow {
+		return s.AllowedStaleness / searchRefreshLeadFraction
+	}
+	return searchRefreshWindow
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRefreshSearchesSmallStaleness(t *testing.T) {
+	srv := newFakeChefServer(t, map[string][]string{"role:web": {"web1"}}, &chef.Node{Name: "web1", RunList: []string{"role[web]"}})
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+	testWrite(t, b, storage, "config", map[string]interface{}{
+		"host":        srv.URL + "/",
+		"client_name": "vault",
+		"client_key":  testPrivateKey(t),
+	})
+	// Smaller than the refresh window
+	testWrite(t, b, storage, "search/web", map[string]interface{}{
+		"search_query":      "role:web",
+		"policies":          "web",
+		"allowed_staleness": 10,
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := b.refreshSearches(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if searches := atomic.LoadInt64(&srv.searches); searches != 1 {
+		t.Errorf("the Chef server received %d searches, expected 1", searches)
+	}
+}
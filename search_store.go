@@ -2,83 +2,353 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
-func (b *backend) MatchingSearches(r *logical.Request, client *chef.Client) ([]string, []string, error) {
-	policies := []string{}
-	matchedSearches := []string{}
-	searches, err := b.getSearchEntriesFromStorage(context.Background(), r)
+// MatchingSearches returns the stored searches the node is part of, in storage order. Searches run on the Chef
+// server are evaluated concurrently, by at most search_concurrency workers, until ctx, bounded by search_timeout, is
+// done. Searches which can't be evaluated are handled according to their on_error, the returned warnings report the
+// ones which were skipped or used a stale result.
+func (b *backend) MatchingSearches(ctx context.Context, r *logical.Request, conf *config, client *chefClient, node *chef.Node) ([]*ChefSearch, []string, error) {
+	searches, err := b.getSearchEntriesFromStorage(ctx, r)
 	if err != nil {
 		return nil, nil, err
 	}
-	for _, s := range searches {
-		ok, err := b.isNodeInSearch(r, client, s)
+
+	if conf.SearchTimeout != 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, conf.SearchTimeout)
+		defer cancelTimeout()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		matched  = make([]bool, len(searches))
+		warnings = make([]string, len(searches))
+		fields   map[string][]string
+		sem      = make(chan struct{}, conf.searchConcurrency())
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	failed := func(i int, s *ChefSearch, err error) {
+		ok, warning, err := b.handleSearchError(r, s, node.Name, err)
 		if err != nil {
-			return nil, policies, err
+			errOnce.Do(func() {
+				firstErr = err
+				cancel()
+			})
+			return
+		}
+		matched[i] = ok
+		warnings[i] = warning
+	}
+	for i, s := range searches {
+		if s.evaluatesLocally() {
+			q, err := parseSearchQuery(s.Search)
+			if err == nil {
+				if fields == nil {
+					fields = indexedFields(node)
+				}
+				matched[i] = q.matches(fields)
+				continue
+			}
+			b.Logger().Debug("evaluating search on the Chef server", "search", s.Name, "reason", err)
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			failed(i, s, fmt.Errorf("not evaluated in time: %s", err))
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s *ChefSearch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var ok bool
+			var err error
+			if s.evaluation() == searchEvaluationNodeScoped {
+				ok, err = isNodeInScopedSearch(ctx, client, node.Name, s)
+			} else {
+				ok, err = b.isNodeInSearch(ctx, r, client, node.Name, s)
+			}
+			if err != nil {
+				failed(i, s, err)
+				return
+			}
+			matched[i] = ok
+		}(i, s)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+
+	matchedSearches := []*ChefSearch{}
+	var searchWarnings []string
+	for i, s := range searches {
+		if matched[i] {
+			matchedSearches = append(matchedSearches, s)
+		}
+		if warnings[i] != "" {
+			searchWarnings = append(searchWarnings, warnings[i])
 		}
-		if ok {
-			policies = append(policies, s.Policies...)
-			matchedSearches = append(matchedSearches, s.Name)
+	}
+	return matchedSearches, searchWarnings, nil
+}
+
+// handleSearchError applies the on_error of a search which could not be evaluated. It returns whether the node
+// matches the search, along with a warning for the login response, or the error failing the login.
+func (b *backend) handleSearchError(r *logical.Request, s *ChefSearch, nodeName string, err error) (bool, string, error) {
+	switch s.onError() {
+	case searchOnErrorSkip:
+		b.Logger().Warn("skipping search which can't be evaluated", "search", s.Name, "error", err)
+		return false, fmt.Sprintf("search %q was skipped: %s", s.Name, err), nil
+	case searchOnErrorUseStale:
+		nodes, fetchedAt, ok := b.lastKnownSearch(r.Storage, s)
+		if !ok {
+			b.Logger().Warn("skipping search which can't be evaluated and has no known result", "search", s.Name, "error", err)
+			return false, fmt.Sprintf("search %q was skipped, it has no known result: %s", s.Name, err), nil
 		}
+		b.Logger().Warn("using the last known result of search which can't be evaluated", "search", s.Name, "fetched_at", fetchedAt, "error", err)
+		return nodes[nodeName], fmt.Sprintf("search %q used its result from %s: %s", s.Name, fetchedAt.Format(time.RFC3339), err), nil
 	}
-	return policies, matchedSearches, nil
+	b.Logger().Error("search can't be evaluated", "search", s.Name, "error", err)
+	return false, "", fmt.Errorf("search %q: %s", s.Name, err)
 }
 
-func (b *backend) isNodeInSearch(r *logical.Request, client *chef.Client, s *ChefSearch) (bool, error) {
-	nodes, err := b.nodesForSearch(r, client, s)
+// lastKnownSearch returns the last result of a search, whatever its age, from the cache or from storage.
+func (b *backend) lastKnownSearch(storage logical.Storage, s *ChefSearch) (map[string]bool, time.Time, bool) {
+	if nodes, fetchedAt, ok := b.searchCache.last(strings.ToLower(s.Name)); ok {
+		return nodes, fetchedAt, true
+	}
+	// The login context may be done already, the storage is read anyway since it does not involve the Chef server
+	raw, err := storage.Get(context.Background(), searchCachePrefix+strings.ToLower(s.Name))
+	if err != nil || raw == nil {
+		return nil, time.Time{}, false
+	}
+	p := &persistedSearch{}
+	if err := json.Unmarshal(raw.Value, p); err != nil {
+		return nil, time.Time{}, false
+	}
+	return p.nodeSet(), p.FetchedAt, true
+}
+
+func (b *backend) isNodeInSearch(ctx context.Context, r *logical.Request, client *chefClient, nodeName string, s *ChefSearch) (bool, error) {
+	nodes, err := b.nodesForSearch(ctx, r, client, s)
 	if err != nil {
 		return false, err
 	}
-	_, ok := nodes[client.Auth.ClientName]
+	_, ok := nodes[nodeName]
 	return ok, nil
 }
 
-func (b *backend) nodesForSearch(r *logical.Request, client *chef.Client, s *ChefSearch) (map[string]bool, error) {
-	st := b.SearchStore
-	name := s.Name
-	if _, ok := st.Load(name); ok {
-		return nil, nil
+// isNodeInScopedSearch restricts the search to the results whose identity field holds the node name, with a
+// partial search only returning this field, so only a few small rows are transferred.
+func isNodeInScopedSearch(ctx context.Context, client *chefClient, nodeName string, s *ChefSearch) (bool, error) {
+	keys := strings.Split(s.identityField(), ".")
+	// Chef indexes nested fields under their keys joined by underscores
+	query := fmt.Sprintf("(%s) AND %s:%s", s.Search, strings.Join(keys, "_"), escapeSearchValue(nodeName))
+	filter := map[string][]string{
+		"identity": keys,
+		// Data bag items hold their fields in raw_data
+		"raw_identity": append([]string{"raw_data"}, keys...),
+	}
+	rs, err := client.partialSearch(ctx, s.index(), query, filter)
+	if err != nil {
+		return false, fmt.Errorf("Error while executing the search: %s", err)
+	}
+	for _, rowRaw := range rs.Rows {
+		row, _ := rowRaw.(map[string]interface{})
+		data, _ := row["data"].(map[string]interface{})
+		for _, k := range []string{"identity", "raw_identity"} {
+			if data[k] == nil {
+				continue
+			}
+			names, err := identityValues(data[k])
+			if err != nil {
+				return false, err
+			}
+			if strutil.StrListContains(names, nodeName) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// searchRowIdentity returns the value of the identity field of a search result, looked up in the raw data of
+// data bag items.
+func searchRowIdentity(row map[string]interface{}, field string) (interface{}, bool) {
+	keys := strings.Split(field, ".")
+	if rawData, ok := row["raw_data"].(map[string]interface{}); ok {
+		if v, ok := lookupKeys(rawData, keys); ok {
+			return v, true
+		}
+	}
+	return lookupKeys(row, keys)
+}
+
+// identityValues returns the node names held by an identity field, a string or a list of strings.
+func identityValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		names := make([]string, 0, len(v))
+		for _, item := range v {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Identity \"%+v\" is incorrect from the response of Chef", item)
+			}
+			names = append(names, name)
+		}
+		return names, nil
+	}
+	return nil, fmt.Errorf("Identity \"%+v\" is incorrect from the response of Chef", v)
+}
+
+// escapeSearchValue escapes the characters having a meaning in the Solr query syntax.
+func escapeSearchValue(value string) string {
+	var escaped strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(`+-&|!(){}[]^"~*?:\/ `, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// searchCachePrefix is the storage prefix of the search results shared by the Vault nodes
+const searchCachePrefix = "cache/search/"
+
+// persistedSearch is the result of a search, as stored for the other Vault nodes
+type persistedSearch struct {
+	Nodes     []string  `json:"nodes"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+func (p *persistedSearch) nodeSet() map[string]bool {
+	nodes := make(map[string]bool, len(p.Nodes))
+	for _, n := range p.Nodes {
+		nodes[n] = true
+	}
+	return nodes
+}
+
+func (b *backend) nodesForSearch(ctx context.Context, r *logical.Request, client *chefClient, s *ChefSearch) (map[string]bool, error) {
+	return b.searchCache.get(ctx, strings.ToLower(s.Name), client.identity(), s.AllowedStaleness, func(ctx context.Context) (map[string]bool, time.Time, error) {
+		// Stored results are only reused while they are fresh, a refresh must not load back the result it replaces
+		return b.loadOrFetchSearch(ctx, r.Storage, client, s, s.AllowedStaleness/2)
+	})
+}
+
+// loadOrFetchSearch returns the stored result of a search when it is younger than maxAge. Otherwise it runs the
+// search on the Chef server and stores the result, so the other Vault nodes do not have to.
+func (b *backend) loadOrFetchSearch(ctx context.Context, storage logical.Storage, client *chefClient, s *ChefSearch, maxAge time.Duration) (map[string]bool, time.Time, error) {
+	key := searchCachePrefix + strings.ToLower(s.Name)
+
+	if s.AllowedStaleness != 0 {
+		raw, err := storage.Get(ctx, key)
+		if err != nil {
+			b.Logger().Warn("can't read the stored search result", "search", s.Name, "error", err)
+		} else if raw != nil {
+			p := &persistedSearch{}
+			if err := json.Unmarshal(raw.Value, p); err == nil && time.Since(p.FetchedAt) < maxAge {
+				return p.nodeSet(), p.FetchedAt, nil
+			}
+		}
 	}
 
-	rs, err := client.Search.Exec("node", s.Search)
+	fetchedAt := time.Now()
+	nodes, err := b.fetchSearchNodes(ctx, client, s)
+	if err != nil {
+		return nil, fetchedAt, err
+	}
+	if s.AllowedStaleness == 0 {
+		return nodes, fetchedAt, nil
+	}
+
+	p := &persistedSearch{Nodes: make([]string, 0, len(nodes)), FetchedAt: fetchedAt}
+	for n := range nodes {
+		p.Nodes = append(p.Nodes, n)
+	}
+	entry, err := logical.StorageEntryJSON(key, p)
+	if err != nil {
+		return nil, fetchedAt, err
+	}
+	// Performance standbys can't write, they still share the results stored by the active node
+	if err := storage.Put(ctx, entry); err != nil && err != logical.ErrReadOnly {
+		b.Logger().Warn("can't store the search result", "search", s.Name, "error", err)
+	}
+	return nodes, fetchedAt, nil
+}
+
+// deleteStoredSearches removes the stored results of the searches, or of every search when name is empty.
+func (b *backend) deleteStoredSearches(ctx context.Context, storage logical.Storage, name string) error {
+	keys := []string{strings.ToLower(name)}
+	if name == "" {
+		var err error
+		if keys, err = storage.List(ctx, searchCachePrefix); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if err := storage.Delete(ctx, searchCachePrefix+k); err != nil && err != logical.ErrReadOnly {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchSearchNodes runs the search on the Chef server, returning the names of the matching nodes.
+func (b *backend) fetchSearchNodes(ctx context.Context, client *chefClient, s *ChefSearch) (map[string]bool, error) {
+	rs, err := client.search(ctx, s.index(), s.Search)
 	if err != nil {
 		return nil, fmt.Errorf("Error while executing the search: %s", err)
 	}
 
 	if len(rs.Rows) == 0 {
-		b.Logger().Warn("search \"%s\" returned 0 entries", s.Name)
+		b.Logger().Warn("search returned 0 entries", "search", s.Name)
 	}
 
 	nodes := make(map[string]bool, len(rs.Rows))
-	for _, nodeRaw := range rs.Rows {
-		node, ok := nodeRaw.(map[string]interface{})
+	for _, rowRaw := range rs.Rows {
+		row, ok := rowRaw.(map[string]interface{})
 		if !ok {
 			err := fmt.Errorf("Invalid type for data returned by Chef")
 			b.Logger().Error(err.Error())
 			return nil, err
 		}
-		nameRaw, ok := node["name"]
+		identity, ok := searchRowIdentity(row, s.identityField())
 		if !ok {
-			err := fmt.Errorf("Name is missing from the response of Chef")
-			b.Logger().Error(err.Error())
-			return nil, err
+			// Data bag items may not all hold the field
+			b.Logger().Debug("search result without identity field", "search", s.Name, "identity_field", s.identityField())
+			continue
 		}
-		name, ok := nameRaw.(string)
-		if !ok {
-			err := fmt.Errorf("Name \"%+v\" is incorrect from the response of Chef", nameRaw)
+		names, err := identityValues(identity)
+		if err != nil {
 			b.Logger().Error(err.Error())
 			return nil, err
 		}
-		nodes[name] = true
-	}
-	if s.AllowedStaleness != 0 {
-		st.Store(s.Name, nodes)
-		time.AfterFunc(s.AllowedStaleness, func() { st.Delete(s.Name) })
+		for _, name := range names {
+			nodes[name] = true
+		}
 	}
 	return nodes, nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// fakeChefServer answers node searches, full and partial, with the fixed result set of each query. Queries scoped
+// to a node, "(<query>) AND name:<escaped name>", get the result set of the query restricted to that node.
+type fakeChefServer struct {
+	*httptest.Server
+	nodes map[string]*chef.Node
+	// results holds the names of the nodes matching each query
+	results  map[string][]string
+	searches int64
+	// delay slows down the searches
+	delay time.Duration
+}
+
+func newFakeChefServer(t testing.TB, results map[string][]string, nodes ...*chef.Node) *fakeChefServer {
+	s := &fakeChefServer{nodes: map[string]*chef.Node{}, results: results}
+	for _, n := range nodes {
+		s.nodes[n.Name] = n
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveSearch))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// searchSpecialChars are the characters which must be escaped in the values of search queries
+const searchSpecialChars = ` +-&|!(){}[]^"~*?:\/`
+
+// scopedSearch splits a query scoped to a node into the query and the node name, failing on unescaped special
+// characters in the name.
+func scopedSearch(q string) (string, string, bool, error) {
+	i := strings.LastIndex(q, ") AND name:")
+	if !strings.HasPrefix(q, "(") || i < 0 {
+		return q, "", false, nil
+	}
+	escaped := q[i+len(") AND name:"):]
+	name := strings.Builder{}
+	for j := 0; j < len(escaped); j++ {
+		c := escaped[j]
+		if c == '\\' && j+1 < len(escaped) {
+			j++
+			name.WriteByte(escaped[j])
+			continue
+		}
+		if strings.IndexByte(searchSpecialChars, c) >= 0 {
+			return "", "", false, fmt.Errorf("unescaped %q in %q", c, escaped)
+		}
+		name.WriteByte(c)
+	}
+	return q[1:i], name.String(), true, nil
+}
+
+func (s *fakeChefServer) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/search/node" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	atomic.AddInt64(&s.searches, 1)
+	time.Sleep(s.delay)
+
+	q, nodeName, scoped, err := scopedSearch(r.URL.Query().Get("q"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	names, ok := s.results[q]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var filter map[string][]string
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows := []interface{}{}
+	for _, name := range names {
+		n := s.nodes[name]
+		if n == nil || scoped && name != nodeName {
+			continue
+		}
+		if filter == nil {
+			rows = append(rows, n)
+			continue
+		}
+		attrs := nodeAttributes(n)
+		data := map[string]interface{}{}
+		for k, path := range filter {
+			data[k], _ = lookupKeys(attrs, path)
+		}
+		rows = append(rows, map[string]interface{}{"url": s.URL + "/nodes/" + n.Name, "data": data})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"total": len(rows), "start": 0, "rows": rows})
+}
+
+func (s *fakeChefServer) client(t testing.TB) *chefClient {
+	client, err := newChefClient(&config{Host: s.URL + "/"}, "vault", testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestScopedSearchMatchesFullScan(t *testing.T) {
+	node := func(name, environment string, roles ...string) *chef.Node {
+		runList := []string{}
+		for _, r := range roles {
+			runList = append(runList, "role["+r+"]")
+		}
+		return &chef.Node{Name: name, Environment: environment, RunList: runList}
+	}
+	srv := newFakeChefServer(t, map[string][]string{
+		"role:web": {"web1", "web10", "web-2:blue", "web (3)", `web\4`},
+		"role:web AND chef_environment:production": {"web1", "web10", "web (3)", `web\4`},
+		"role:web AND NOT role:legacy":             {"web1", "web10", "web-2:blue", `web\4`},
+		"role:db OR chef_environment:staging":      {"db1", "web-2:blue"},
+	},
+		node("web1", "production", "web"),
+		node("web10", "production", "web"),
+		node("db1", "production", "db"),
+		node("web-2:blue", "staging", "web"),
+		node("web (3)", "production", "web", "legacy"),
+		node(`web\4`, "production", "web"),
+	)
+	client := srv.client(t)
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+
+	tests := []struct {
+		query string
+		node  string
+		match bool
+	}{
+		{"role:web", "web1", true},
+		{"role:web", "db1", false},
+		{"role:web", "web10", true},
+		{"role:web", "web-2:blue", true},
+		{"role:web", "web (3)", true},
+		{"role:web", `web\4`, true},
+		{"role:web", "unknown", false},
+		// The scoped query must not match other nodes sharing a prefix
+		{"role:web", "web", false},
+		{"role:web", "web-2", false},
+		{"role:web AND chef_environment:production", "web-2:blue", false},
+		{"role:web AND NOT role:legacy", "web (3)", false},
+		{"role:web AND NOT role:legacy", "web1", true},
+		{"role:db OR chef_environment:staging", "web-2:blue", true},
+		{"role:db OR chef_environment:staging", "web1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query+"/"+tt.node, func(t *testing.T) {
+			s := &ChefSearch{Name: "test", Search: tt.query}
+
+			scoped, err := isNodeInScopedSearch(context.Background(), client, tt.node, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			full, err := b.isNodeInSearch(context.Background(), req, client, tt.node, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scoped != full {
+				t.Errorf("node_scoped matched %v, remote matched %v", scoped, full)
+			}
+			if scoped != tt.match {
+				t.Errorf("matched %v, expected %v", scoped, tt.match)
+			}
+		})
+	}
+}
+
+func TestEscapeSearchValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"web1.example.com": "web1.example.com",
+		"web-2:blue":       `web\-2\:blue`,
+		"web (3)":          `web\ \(3\)`,
+		`web\4`:            `web\\4`,
+		"a+b&&c||d!":       `a\+b\&\&c\|\|d\!`,
+	} {
+		if got := escapeSearchValue(value); got != expected {
+			t.Errorf("escapeSearchValue(%q) = %q, expected %q", value, got, expected)
+		}
+	}
+	if !strings.Contains(escapeSearchValue("*?"), `\*\?`) {
+		t.Errorf("wildcards must be escaped")
+	}
+}
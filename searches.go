@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -17,6 +19,116 @@ type ChefSearch struct {
 	AllowedStaleness time.Duration
 	Search           string
 	Policies         []string
+	TokenType        logical.TokenType
+	// Evaluation is how nodes are matched against the search, searches stored before it existed are remote
+	Evaluation string
+	// OnError is what happens to logins when the search can't be evaluated, searches stored before it existed fail
+	OnError string
+	// Index is the Chef index searched, a data bag name or one of the built-in indexes, searches stored before it
+	// existed search nodes
+	Index string
+	// IdentityField is the dotted path of the field of the search results holding the names of the matching nodes
+	IdentityField string
+	mappingParams
+}
+
+const (
+	searchIndexNode        = "node"
+	searchIndexClient      = "client"
+	searchIndexRole        = "role"
+	searchIndexEnvironment = "environment"
+)
+
+var (
+	// searchIndexRegex matches the built-in indexes as well as data bag names
+	searchIndexRegex = regexp.MustCompile(`^[\w.:-]+$`)
+	// identityFieldRegex matches dotted paths of fields
+	identityFieldRegex = regexp.MustCompile(`^[\w-]+(\.[\w-]+)*$`)
+)
+
+const (
+	// searchEvaluationLocal matches the search query against the node fetched at login, falling back on
+	// the Chef server for unsupported syntax
+	searchEvaluationLocal = "local"
+	// searchEvaluationRemote runs the search on the Chef server
+	searchEvaluationRemote = "remote"
+	// searchEvaluationNodeScoped runs the search on the Chef server, restricted to the login node
+	searchEvaluationNodeScoped = "node_scoped"
+)
+
+var searchEvaluations = []string{searchEvaluationLocal, searchEvaluationRemote, searchEvaluationNodeScoped}
+
+const (
+	// searchOnErrorFail fails the login
+	searchOnErrorFail = "fail"
+	// searchOnErrorSkip considers the node does not match the search
+	searchOnErrorSkip = "skip"
+	// searchOnErrorUseStale matches the node against the last known result of the search, whatever its age,
+	// and skips the search when there is none
+	searchOnErrorUseStale = "use_stale"
+)
+
+var searchOnErrors = []string{searchOnErrorFail, searchOnErrorSkip, searchOnErrorUseStale}
+
+// usesCache reports whether matching nodes against the search may read the search cache.
+func (s *ChefSearch) usesCache() bool {
+	if s.AllowedStaleness == 0 {
+		return false
+	}
+	switch s.evaluation() {
+	case searchEvaluationNodeScoped:
+		return false
+	case searchEvaluationLocal:
+		if !s.evaluatesLocally() {
+			return true
+		}
+		// Local searches only run on the Chef server when the local matcher does not support their query
+		_, err := parseSearchQuery(s.Search)
+		return err != nil
+	}
+	return true
+}
+
+// index returns the Chef index searched.
+func (s *ChefSearch) index() string {
+	if s.Index == "" {
+		return searchIndexNode
+	}
+	return s.Index
+}
+
+// identityField returns the field of the search results holding node names: the object name on the built-in
+// indexes, the item id on data bags.
+func (s *ChefSearch) identityField() string {
+	if s.IdentityField != "" {
+		return s.IdentityField
+	}
+	switch s.index() {
+	case searchIndexNode, searchIndexClient, searchIndexRole, searchIndexEnvironment:
+		return "name"
+	}
+	return "id"
+}
+
+// evaluatesLocally reports whether the search may be matched against the node fetched at login.
+func (s *ChefSearch) evaluatesLocally() bool {
+	return s.evaluation() == searchEvaluationLocal && s.index() == searchIndexNode && s.identityField() == "name"
+}
+
+// onError returns what happens to logins when the search can't be evaluated.
+func (s *ChefSearch) onError() string {
+	if s.OnError == "" {
+		return searchOnErrorFail
+	}
+	return s.OnError
+}
+
+// evaluation returns how nodes are matched against the search.
+func (s *ChefSearch) evaluation() string {
+	if s.Evaluation == "" {
+		return searchEvaluationRemote
+	}
+	return s.Evaluation
 }
 
 func pathSearch(b *backend) []*framework.Path {
@@ -32,6 +144,7 @@ func pathSearch(b *backend) []*framework.Path {
 			HelpSynopsis:    "Remove the cache entries for saved searches.",
 			HelpDescription: "Remove the cache entries for saved searches.",
 		},
+		pathSearchCache(b),
 		{
 			Pattern: "search/",
 			Fields:  map[string]*framework.FieldSchema{},
@@ -44,24 +157,7 @@ func pathSearch(b *backend) []*framework.Path {
 		},
 		{
 			Pattern: "search/" + framework.GenericNameRegex("name"),
-			Fields: map[string]*framework.FieldSchema{
-				"name": {
-					Type:        framework.TypeNameString,
-					Description: "The desired name for the search.",
-				},
-				"allowed_staleness": {
-					Type:        framework.TypeDurationSecond,
-					Description: "An optional cache to avoid hitting too hard on Chef servers. 0 mean no cache.",
-				},
-				"search_query": {
-					Type:        framework.TypeString,
-					Description: "The SolR search query.",
-				},
-				"policies": {
-					Type:        framework.TypeStringSlice,
-					Description: "The policies which should get associated with matching nodes.",
-				},
-			},
+			Fields:  searchFields(),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.pathSearchRead,
 				logical.CreateOperation: b.pathSearchUpdateOrCreate,
@@ -76,6 +172,52 @@ func pathSearch(b *backend) []*framework.Path {
 
 }
 
+func searchFields() map[string]*framework.FieldSchema {
+	fields := map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeNameString,
+			Description: "The desired name for the search.",
+		},
+		"allowed_staleness": {
+			Type:        framework.TypeDurationSecond,
+			Description: "An optional cache to avoid hitting too hard on Chef servers. 0 mean no cache.",
+		},
+		"search_query": {
+			Type:        framework.TypeString,
+			Description: "The SolR search query.",
+		},
+		"policies": {
+			Type:        framework.TypeStringSlice,
+			Description: "The policies which should get associated with matching nodes.",
+		},
+		"evaluation": {
+			Type:        framework.TypeString,
+			Default:     searchEvaluationRemote,
+			Description: "How nodes are matched against the search: remote (default) runs the search on the Chef server, local evaluates the query against the node fetched at login, falling back on the Chef server for unsupported syntax, node_scoped runs the search on the Chef server restricted to the login node.",
+		},
+		"token_type": {
+			Type:        framework.TypeString,
+			Description: "The type of token matching nodes should get, service or batch. Only used when no mapping evaluated before the search sets one.",
+		},
+		"index": {
+			Type:        framework.TypeString,
+			Default:     searchIndexNode,
+			Description: "The Chef index searched: node, client, role, environment or the name of a data bag. Searches on other indexes than node are always run on the Chef server.",
+		},
+		"identity_field": {
+			Type:        framework.TypeString,
+			Description: "The dotted path of the field of the search results holding the names of the matching nodes, either a string or a list of strings. Data bag items are looked up in their raw data. Defaults to name, or id for data bags.",
+		},
+		"on_error": {
+			Type:        framework.TypeString,
+			Default:     searchOnErrorFail,
+			Description: "What happens to logins when the search can't be evaluated: fail fails the login, skip considers the node does not match, use_stale uses the last known result of the search, whatever its age, or skips it when there is none.",
+		},
+	}
+	addMappingFields(fields, combineAdditive)
+	return fields
+}
+
 func (b *backend) getSearchEntriesFromStorage(ctx context.Context, r *logical.Request) ([]*ChefSearch, error) {
 	b.RLock()
 	b.RUnlock()
@@ -119,11 +261,8 @@ func (b *backend) getSearchEntryFromStorage(ctx context.Context, r *logical.Requ
 }
 
 func (b *backend) pathSearchRefresh(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	b.SearchStore.Range(func(key, value interface{}) bool {
-		b.SearchStore.Delete(key)
-		return true
-	})
-	return nil, nil
+	b.searchCache.purge()
+	return nil, b.deleteStoredSearches(ctx, req.Storage, "")
 }
 
 func (b *backend) pathSearchExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
@@ -155,9 +294,40 @@ func (b *backend) pathSearchUpdateOrCreate(ctx context.Context, req *logical.Req
 			Policies:         []string{},
 			AllowedStaleness: 0,
 			Search:           search,
+			Evaluation:       d.Get("evaluation").(string),
+			OnError:          d.Get("on_error").(string),
+			Index:            d.Get("index").(string),
+			IdentityField:    d.Get("identity_field").(string),
 		}
 	}
 
+	if indexRaw, ok := d.GetOk("index"); ok {
+		s.Index = indexRaw.(string)
+	}
+	if !searchIndexRegex.MatchString(s.index()) {
+		return logical.ErrorResponse("index must be node, client, role, environment or a data bag name"), nil
+	}
+	if identityFieldRaw, ok := d.GetOk("identity_field"); ok {
+		s.IdentityField = identityFieldRaw.(string)
+	}
+	if !identityFieldRegex.MatchString(s.identityField()) {
+		return logical.ErrorResponse("identity_field must be a dotted path, e.g. clients or vault.nodes"), nil
+	}
+
+	if evaluationRaw, ok := d.GetOk("evaluation"); ok {
+		s.Evaluation = evaluationRaw.(string)
+	}
+	if !strutil.StrListContains(searchEvaluations, s.evaluation()) {
+		return logical.ErrorResponse(fmt.Sprintf("evaluation must be one of %s", strings.Join(searchEvaluations, ", "))), nil
+	}
+
+	if onErrorRaw, ok := d.GetOk("on_error"); ok {
+		s.OnError = onErrorRaw.(string)
+	}
+	if !strutil.StrListContains(searchOnErrors, s.onError()) {
+		return logical.ErrorResponse(fmt.Sprintf("on_error must be one of %s", strings.Join(searchOnErrors, ", "))), nil
+	}
+
 	if policiesRaw, ok := d.GetOk("policies"); ok {
 		s.Policies = policiesRaw.([]string)
 	}
@@ -166,9 +336,23 @@ func (b *backend) pathSearchUpdateOrCreate(ctx context.Context, req *logical.Req
 		s.AllowedStaleness = time.Duration(intervalRaw.(int)) * time.Second
 	}
 
+	if err := s.parseMappingFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if tokenTypeRaw, ok := d.GetOk("token_type"); ok {
+		s.TokenType, err = parseTokenType(tokenTypeRaw.(string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
 	b.Lock()
 	defer b.Unlock()
-	b.SearchStore.Delete(name)
+	b.searchCache.invalidate(strings.ToLower(name))
+	if err := b.deleteStoredSearches(ctx, req.Storage, name); err != nil {
+		return nil, err
+	}
 
 	entry, err := logical.StorageEntryJSON("search/"+strings.ToLower(name), s)
 	if err != nil {
@@ -196,8 +380,14 @@ func (b *backend) pathSearchRead(ctx context.Context, req *logical.Request, d *f
 			"name":              search.Name,
 			"search_query":      search.Search,
 			"allowed_staleness": search.AllowedStaleness.Seconds(),
+			"token_type":        search.TokenType.String(),
+			"evaluation":        search.evaluation(),
+			"on_error":          search.onError(),
+			"index":             search.index(),
+			"identity_field":    search.identityField(),
 		},
 	}
+	search.populateMappingData(resp.Data, combineAdditive)
 
 	return resp, nil
 }
@@ -231,5 +421,6 @@ func (b *backend) pathSearchDelete(ctx context.Context, req *logical.Request, d
 	if err := req.Storage.Delete(ctx, "search/"+strings.ToLower(name)); err != nil {
 		return nil, err
 	}
-	return nil, nil
+	b.searchCache.invalidate(strings.ToLower(name))
+	return nil, b.deleteStoredSearches(ctx, req.Storage, name)
 }
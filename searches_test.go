@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestSearchUpdateStoredBeforeEvaluation(t *testing.T) {
+	b, storage := testBackend(t)
+
+	// Searches stored before the evaluation field existed
+	entry, err := logical.StorageEntryJSON("search/legacy", &ChefSearch{Name: "legacy", Search: "role:web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	testWrite(t, b, storage, "search/legacy", map[string]interface{}{
+		"search_query": "role:web",
+		"policies":     "web",
+	})
+
+	resp, err := testRequest(t, b, storage, logical.ReadOperation, "search/legacy", nil)
+	if err != nil || resp == nil {
+		t.Fatalf("reading the search: %v %v", resp, err)
+	}
+	if resp.Data["evaluation"] != searchEvaluationRemote {
+		t.Errorf("expected the search to stay remote, got %v", resp.Data["evaluation"])
+	}
+}
+
+func TestSearchEvaluationDefault(t *testing.T) {
+	b, storage := testBackend(t)
+	testWrite(t, b, storage, "search/web", map[string]interface{}{
+		"search_query": "role:web",
+		"policies":     "web",
+	})
+
+	resp, err := testRequest(t, b, storage, logical.ReadOperation, "search/web", nil)
+	if err != nil || resp == nil {
+		t.Fatalf("reading the search: %v %v", resp, err)
+	}
+	if resp.Data["evaluation"] != searchEvaluationRemote {
+		t.Errorf("expected new searches to be remote, got %v", resp.Data["evaluation"])
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightGroup collapses the concurrent fetches of a search into a single call to the Chef server
+type flightGroup struct {
+	sync.Mutex
+	calls map[flightKey]*flightCall
+	// wg tracks the fetches in flight, so stop can wait for them
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// flightKey identifies the fetches which can be shared: those of the same search by the same Chef client, the
+// fetches of another configuration must not answer each other
+type flightKey struct {
+	name   string
+	client string
+}
+
+// flightCall is a fetch in flight, or completed, whose result is shared by its callers
+type flightCall struct {
+	done      chan struct{}
+	nodes     map[string]bool
+	fetchedAt time.Time
+	err       error
+}
+
+// do calls fetch with runCtx, unless a fetch of the same key is already in flight, and waits for the result until
+// ctx is done. The fetch is not bound to ctx since other callers may be waiting for it. shared reports whether the
+// result came from another caller's fetch.
+func (g *flightGroup) do(ctx, runCtx context.Context, key flightKey, fetch searchFetcher) (nodes map[string]bool, fetchedAt time.Time, shared bool, err error) {
+	g.Lock()
+	if g.stopped {
+		g.Unlock()
+		return nil, time.Time{}, false, context.Canceled
+	}
+	if g.calls == nil {
+		g.calls = map[flightKey]*flightCall{}
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		c = &flightCall{done: make(chan struct{})}
+		g.calls[key] = c
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			c.nodes, c.fetchedAt, c.err = fetch(runCtx)
+			g.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.Unlock()
+			close(c.done)
+		}()
+	}
+	g.Unlock()
+
+	select {
+	case <-c.done:
+		return c.nodes, c.fetchedAt, shared, c.err
+	case <-ctx.Done():
+		return nil, time.Time{}, shared, ctx.Err()
+	}
+}
+
+// forget makes the next calls of the search name, by any client, start a new fetch instead of waiting for the one
+// in flight.
+func (g *flightGroup) forget(name string) {
+	g.Lock()
+	defer g.Unlock()
+	for key := range g.calls {
+		if key.name == name {
+			delete(g.calls, key)
+		}
+	}
+}
+
+// forgetAll is forget for every key.
+func (g *flightGroup) forgetAll() {
+	g.Lock()
+	defer g.Unlock()
+	g.calls = nil
+}
+
+// stop waits for the fetches in flight to return, no fetch is started afterwards.
+func (g *flightGroup) stop() {
+	g.Lock()
+	g.stopped = true
+	g.Unlock()
+	g.wg.Wait()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestConcurrentExpiredSearchFetchedOnce(t *testing.T) {
+	const callers = 50
+
+	srv := newFakeChefServer(t, map[string][]string{"role:web": {"web1"}}, &chef.Node{Name: "web1", RunList: []string{"role[web]"}})
+	srv.delay = 100 * time.Millisecond
+	client := srv.client(t)
+	b, storage := testBackend(t)
+	req := &logical.Request{Storage: storage}
+	s := &ChefSearch{Name: "Web", Search: "role:web", AllowedStaleness: time.Hour}
+
+	// An expired result, so every caller needs a fetch
+	name := strings.ToLower(s.Name)
+	b.searchCache.store(name, b.searchCache.generation(name), time.Hour, map[string]bool{}, time.Now().Add(-2*time.Hour))
+
+	start := make(chan struct{})
+	errs := make(chan error, callers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			nodes, err := b.nodesForSearch(context.Background(), req, client, s)
+			if err == nil && !nodes["web1"] {
+				err = fmt.Errorf("unexpected nodes %v", nodes)
+			}
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if searches := atomic.LoadInt64(&srv.searches); searches != 1 {
+		t.Errorf("the Chef server received %d searches, expected 1", searches)
+	}
+	// Callers arriving after the fetch read the cache instead of waiting for it
+	stats := b.searchCache.stats
+	if stats.SharedFetches+stats.Hits != callers-1 {
+		t.Errorf("expected %d shared fetches or hits, got %+v", callers-1, stats)
+	}
+}
+
+func TestFlightNotSharedAcrossClients(t *testing.T) {
+	c := testSearchCache(t)
+	var fetches int64
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (map[string]bool, time.Time, error) {
+		atomic.AddInt64(&fetches, 1)
+		started <- struct{}{}
+		<-release
+		return map[string]bool{"web1": true}, time.Now(), nil
+	}
+
+	errs := make(chan error, 2)
+	for _, client := range []string{"vault@https://chef1/", "vault@https://chef2/"} {
+		go func(client string) {
+			_, err := c.get(context.Background(), "web", client, time.Hour, fetch)
+			errs <- err
+		}(client)
+	}
+	// Both fetches start, neither waits for the other
+	<-started
+	<-started
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("expected a fetch per client, got %d", fetches)
+	}
+}
+
+func TestSearchCacheStopWaitsForFetches(t *testing.T) {
+	c := newSearchCache(func(msg string, args ...interface{}) {})
+	started := make(chan struct{})
+	var returned int32
+	fetch := func(ctx context.Context) (map[string]bool, time.Time, error) {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+		return nil, time.Now(), ctx.Err()
+	}
+
+	// The caller gives up, the fetch keeps running for the other callers
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := c.get(ctx, "web", "vault", time.Hour, fetch)
+		done <- err
+	}()
+	<-started
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected the caller to give up, got %v", err)
+	}
+
+	c.stop()
+	if atomic.LoadInt32(&returned) == 0 {
+		t.Error("stop returned before the fetch in flight")
+	}
+	if _, err := c.get(context.Background(), "web", "vault", time.Hour, fetch); err == nil {
+		t.Error("expected no fetch to start once stopped")
+	}
+}
+
+// BenchmarkConcurrentExpiredSearch measures a burst of logins on an expired search, reporting the searches reaching
+// the Chef server per burst.
+func BenchmarkConcurrentExpiredSearch(bm *testing.B) {
+	const callers = 100
+
+	srv := newFakeChefServer(bm, map[string][]string{"role:web": {"web1"}}, &chef.Node{Name: "web1", RunList: []string{"role[web]"}})
+	client := srv.client(bm)
+	b, storage := testBackend(bm)
+	req := &logical.Request{Storage: storage}
+	s := &ChefSearch{Name: "web", Search: "role:web", AllowedStaleness: time.Hour}
+
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		// Expires the result, cached and stored
+		b.searchCache.invalidate(s.Name)
+		if err := b.deleteStoredSearches(context.Background(), storage, s.Name); err != nil {
+			bm.Fatal(err)
+		}
+		wg := sync.WaitGroup{}
+		for j := 0; j < callers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := b.nodesForSearch(context.Background(), req, client, s); err != nil {
+					bm.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	bm.ReportMetric(float64(atomic.LoadInt64(&srv.searches))/float64(bm.N), "searches/op")
+}
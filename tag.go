@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// ChefTag represent a node tag that will be matched against the node tags
+type ChefTag struct {
+	tokenutil.TokenParams
+	mappingParams
+
+	Name string `json:"name" structs:"name" mapstructure:"name"`
+}
+
+func pathTag(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "tag/",
+			Fields:  map[string]*framework.FieldSchema{},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathTagList,
+			},
+			ExistenceCheck:  nil,
+			HelpSynopsis:    "List all tags configured",
+			HelpDescription: "List all tags configured",
+		},
+		{
+			Pattern: "tag/" + framework.GenericNameRegex("name"),
+			Fields:  tagFields(),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathTagRead,
+				logical.CreateOperation: b.pathTagUpdateOrCreate,
+				logical.UpdateOperation: b.pathTagUpdateOrCreate,
+				logical.DeleteOperation: b.pathTagDelete,
+			},
+			ExistenceCheck:  b.pathTagExistenceCheck,
+			HelpSynopsis:    "CRUD operations on a single tag",
+			HelpDescription: "Let you read, update, create or delete a single tag.",
+		},
+	}
+
+}
+
+func tagFields() map[string]*framework.FieldSchema {
+	fields := mappingTokenFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeNameString,
+		Description: "The name of the node tag.",
+	}
+	addMappingFields(fields, combineAdditive)
+	return fields
+}
+
+func (b *backend) getTagEntryFromStorage(ctx context.Context, r *logical.Request, name string) (*ChefTag, error) {
+	if name == "" {
+		b.Logger().Warn("empty name passed in getTagEntryFromStorage")
+		return nil, fmt.Errorf("tag's <name> is empty")
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+
+	raw, err := r.Storage.Get(ctx, "tag/"+strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	tag := &ChefTag{}
+	if err := json.Unmarshal(raw.Value, tag); err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (b *backend) pathTagExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	name := d.Get("name").(string)
+
+	p, err := b.getTagEntryFromStorage(ctx, req, name)
+	return p != nil, err
+}
+
+func (b *backend) pathTagUpdateOrCreate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	var err error
+	var t *ChefTag
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+	if req.Operation == logical.UpdateOperation {
+		t, err = b.getTagEntryFromStorage(ctx, req, name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		t = &ChefTag{
+			Name: name,
+		}
+	}
+
+	if err := parseMappingTokenFields(&t.TokenParams, req, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenParams(&t.TokenParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := t.parseMappingFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if t.TokenTTL == 0 && t.TokenPeriod == 0 {
+		return nil, fmt.Errorf("you must provide either token_period or token_ttl")
+	}
+
+	if t.TokenPeriod != 0 {
+		t.TokenMaxTTL = 0
+		t.TokenTTL = 0
+	} else if t.TokenMaxTTL < t.TokenTTL {
+		if t.TokenMaxTTL != 0 {
+			return nil, fmt.Errorf("token_max_ttl should always be left zero or be higher than token_ttl")
+		}
+		t.TokenMaxTTL = t.TokenTTL
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	entry, err := logical.StorageEntryJSON("tag/"+strings.ToLower(name), t)
+	if err != nil {
+		return nil, err
+	}
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) pathTagRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing name"), nil
+	}
+
+	tag, err := b.getTagEntryFromStorage(ctx, req, name)
+	if err != nil {
+		return nil, err
+	} else if tag == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name": tag.Name,
+		},
+	}
+	populateMappingTokenData(&tag.TokenParams, resp.Data)
+	tag.populateMappingData(resp.Data, combineAdditive)
+
+	return resp, nil
+}
+
+func (b *backend) pathTagList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	tags, err := req.Storage.List(ctx, "tag/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(tags), nil
+}
+
+func (b *backend) pathTagDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("missing tag name"), nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if err := req.Storage.Delete(ctx, "tag/"+strings.ToLower(name)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
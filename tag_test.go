@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestTrustedTags(t *testing.T) {
+	api := newChefAPI(t)
+	api.addClient("vault", testRSAKey(t, 1))
+	api.addClient("node1", testRSAKey(t, 0))
+	// node1 was assigned the web role, it added the pci role to its run list and a tag to its normal attributes
+	node := chefNode("node1", "web", "pci")
+	node["normal"] = map[string]interface{}{"tags": []interface{}{"admin"}}
+	api.set("/nodes/node1", node)
+	api.set("/roles/web", map[string]interface{}{"name": "web", "default_attributes": map[string]interface{}{"tags": []interface{}{"frontend"}}})
+	api.set("/roles/pci", map[string]interface{}{"name": "pci", "override_attributes": map[string]interface{}{"tags": []interface{}{"pci"}}})
+	api.set("/environments/_default", map[string]interface{}{"name": "_default"})
+
+	b, storage := testBackend(t)
+	testWrite(t, b, storage, "config", map[string]interface{}{
+		"host":              api.URL + "/",
+		"client_name":       "vault",
+		"client_key":        privateKeyPEM(testRSAKey(t, 1)),
+		"trusted_tags_only": true,
+	})
+	for _, tag := range []string{"admin", "frontend", "pci"} {
+		testWrite(t, b, storage, "tag/"+tag, map[string]interface{}{"token_policies": tag, "token_ttl": 3600})
+	}
+
+	resp, err := testRequest(t, b, storage, logical.UpdateOperation, "login", map[string]interface{}{
+		"node_name":   "node1",
+		"private_key": testPrivateKey(t),
+	})
+	if err != nil || resp == nil || resp.Auth == nil {
+		t.Fatalf("expected login to succeed, got %v %v", resp, err)
+	}
+
+	// The tags set by the node are not trusted, but trusted_tags_only can't tell claimed roles from assigned ones
+	matched := resp.Auth.Metadata["chef-matched-tags"]
+	if strings.Contains(matched, "admin") {
+		t.Errorf("the tag set by the node was trusted: %s", matched)
+	}
+	if matched != "frontend,pci" {
+		t.Errorf("expected the tags of both roles, got %s", matched)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// legacyTokenFields maps the fields accepted by policies and roles before the token_* fields to their replacement
+var legacyTokenFields = map[string]string{
+	"policies": "token_policies",
+	"ttl":      "token_ttl",
+	"max_ttl":  "token_max_ttl",
+	"period":   "token_period",
+}
+
+// mappingTokenFields returns the token_* fields along with their legacy equivalents.
+func mappingTokenFields() map[string]*framework.FieldSchema {
+	fields := map[string]*framework.FieldSchema{
+		"policies": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: tokenutil.DeprecationText("token_policies"),
+			Deprecated:  true,
+		},
+		"ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: tokenutil.DeprecationText("token_ttl"),
+			Deprecated:  true,
+		},
+		"max_ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: tokenutil.DeprecationText("token_max_ttl"),
+			Deprecated:  true,
+		},
+		"period": {
+			Type:        framework.TypeDurationSecond,
+			Description: tokenutil.DeprecationText("token_period"),
+			Deprecated:  true,
+		},
+	}
+	tokenutil.AddTokenFields(fields)
+	return fields
+}
+
+// parseMappingTokenFields parses the token_* fields, falling back on the legacy fields when the new one is absent.
+func parseMappingTokenFields(t *tokenutil.TokenParams, req *logical.Request, d *framework.FieldData) error {
+	if err := t.ParseTokenFields(req, d); err != nil {
+		return err
+	}
+
+	for legacy, field := range legacyTokenFields {
+		if _, ok := d.GetOk(field); ok {
+			continue
+		}
+		raw, ok := d.GetOk(legacy)
+		if !ok {
+			continue
+		}
+		switch field {
+		case "token_policies":
+			t.TokenPolicies = raw.([]string)
+		case "token_ttl":
+			t.TokenTTL = time.Duration(raw.(int)) * time.Second
+		case "token_max_ttl":
+			t.TokenMaxTTL = time.Duration(raw.(int)) * time.Second
+		case "token_period":
+			t.TokenPeriod = time.Duration(raw.(int)) * time.Second
+		}
+	}
+	return nil
+}
+
+// upgradeTokenParams fills the token params of an entry stored before the token_* fields existed.
+func upgradeTokenParams(t *tokenutil.TokenParams, policies []string, ttl, maxTTL, period time.Duration) {
+	if len(t.TokenPolicies) == 0 {
+		t.TokenPolicies = policies
+	}
+	if t.TokenTTL == 0 {
+		t.TokenTTL = ttl
+	}
+	if t.TokenMaxTTL == 0 {
+		t.TokenMaxTTL = maxTTL
+	}
+	if t.TokenPeriod == 0 {
+		t.TokenPeriod = period
+	}
+}
+
+// populateMappingTokenData adds the token_* fields to a read response, along with their legacy equivalents.
+func populateMappingTokenData(t *tokenutil.TokenParams, data map[string]interface{}) {
+	t.PopulateTokenData(data)
+	data["policies"] = data["token_policies"]
+	data["ttl"] = data["token_ttl"]
+	data["max_ttl"] = data["token_max_ttl"]
+	data["period"] = data["token_period"]
+}
+
+// mergeTokenParams adds the token settings of a mapping to those already granted by other mappings.
+// Policies are merged, the strictest TTLs, period and use count win, the first bound CIDRs and
+// explicit token type are kept.
+func mergeTokenParams(t, granted *tokenutil.TokenParams) {
+	t.TokenPolicies = strutil.RemoveDuplicates(append(append([]string{}, t.TokenPolicies...), granted.TokenPolicies...), false)
+	t.TokenTTL = minDuration(t.TokenTTL, granted.TokenTTL)
+	t.TokenMaxTTL = minDuration(t.TokenMaxTTL, granted.TokenMaxTTL)
+	t.TokenExplicitMaxTTL = minDuration(t.TokenExplicitMaxTTL, granted.TokenExplicitMaxTTL)
+	t.TokenPeriod = minDuration(t.TokenPeriod, granted.TokenPeriod)
+	if t.TokenNumUses == 0 || (granted.TokenNumUses != 0 && granted.TokenNumUses < t.TokenNumUses) {
+		t.TokenNumUses = granted.TokenNumUses
+	}
+	if len(t.TokenBoundCIDRs) == 0 {
+		t.TokenBoundCIDRs = granted.TokenBoundCIDRs
+	}
+	if t.TokenType == logical.TokenTypeDefault {
+		t.TokenType = granted.TokenType
+	}
+}
+
+// minDuration returns the smallest non-zero duration.
+func minDuration(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// parseTokenType parses the token types a mapping can request.
+func parseTokenType(tokenType string) (logical.TokenType, error) {
+	switch tokenType {
+	case "", "default":
+		return logical.TokenTypeDefault, nil
+	case "service":
+		return logical.TokenTypeService, nil
+	case "batch":
+		return logical.TokenTypeBatch, nil
+	default:
+		return logical.TokenTypeDefault, fmt.Errorf("invalid token_type %q", tokenType)
+	}
+}
+
+// validateTokenParams rejects the token settings of a single mapping Vault could not honor.
+func validateTokenParams(t *tokenutil.TokenParams) error {
+	return checkBatchToken(t.TokenType, t.TokenPeriod, t.TokenNumUses)
+}
+
+// validateTokenAuth checks the combination of token settings coming from several mappings.
+func validateTokenAuth(auth *logical.Auth) error {
+	return checkBatchToken(auth.TokenType, auth.Period, auth.NumUses)
+}
+
+func checkBatchToken(tokenType logical.TokenType, period time.Duration, numUses int) error {
+	if tokenType != logical.TokenTypeBatch {
+		return nil
+	}
+	if period != 0 {
+		return errors.New("batch tokens cannot be periodic, check token_type and token_period")
+	}
+	if numUses != 0 {
+		return errors.New("batch tokens cannot have a limited use count, check token_type and token_num_uses")
+	}
+	return nil
+}